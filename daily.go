@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+
+	"github.com/gocarina/gocsv"
+
+	"scan_playground/sessionstats"
+)
+
+const dayLayout = "2006-01-02"
+
+type DailyStats struct {
+	Day           string  `csv:"day"`
+	Sessions      int     `csv:"sessions"`
+	Rejected      int     `csv:"rejected"`
+	RejectionRate float64 `csv:"rejection_rate"`
+}
+
+// dailyRejections buckets sessions by the UTC day of CreatedAt and computes
+// the share of them that got rejected. Sessions without a parseable CreatedAt
+// are left out. With zeroFill, days between the first and last one that have
+// no sessions are emitted with zero counts instead of being skipped.
+func dailyRejections(statsMap map[string]*sessionstats.SessionStats, zeroFill bool) []*DailyStats {
+	byDay := make(map[string]*DailyStats)
+
+	for _, s := range statsMap {
+		createdAt, err := time.Parse(time.RFC3339, s.CreatedAt)
+		if err != nil {
+			continue
+		}
+
+		day := createdAt.UTC().Format(dayLayout)
+		d, ok := byDay[day]
+		if !ok {
+			d = &DailyStats{Day: day}
+			byDay[day] = d
+		}
+
+		d.Sessions++
+		if s.RejectedAt != "" {
+			d.Rejected++
+		}
+	}
+
+	days := make([]*DailyStats, 0, len(byDay))
+	for _, d := range byDay {
+		d.RejectionRate = float64(d.Rejected) / float64(d.Sessions)
+		days = append(days, d)
+	}
+
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+
+	if !zeroFill || len(days) == 0 {
+		return days
+	}
+
+	first, _ := time.Parse(dayLayout, days[0].Day)
+	last, _ := time.Parse(dayLayout, days[len(days)-1].Day)
+
+	filled := make([]*DailyStats, 0, len(days))
+	for t := first; !t.After(last); t = t.AddDate(0, 0, 1) {
+		day := t.Format(dayLayout)
+		if d, ok := byDay[day]; ok {
+			filled = append(filled, d)
+		} else {
+			filled = append(filled, &DailyStats{Day: day})
+		}
+	}
+
+	return filled
+}
+
+func writeDailyCSV(path string, days []*DailyStats) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := gocsv.MarshalFile(&days, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func TestDailyRejections(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {CreatedAt: "2022-03-01T10:00:00Z", RejectedAt: "2022-03-01T10:01:00Z"},
+		"s2": {CreatedAt: "2022-03-01T23:59:59Z"},
+		"s3": {CreatedAt: "2022-03-01T23:30:00-02:00", RejectedAt: "2022-03-02T01:31:00Z"},
+		"s4": {CreatedAt: "2022-03-03T08:00:00Z", RejectedAt: "2022-03-03T08:00:30Z"},
+		// Created before the window: left out of every day.
+		"s5": {RejectedAt: "2022-03-02T12:00:00Z"},
+	}
+
+	// s3 was created on 2022-03-02 in UTC.
+	assertDays(t, dailyRejections(stats, false), []DailyStats{
+		{Day: "2022-03-01", Sessions: 2, Rejected: 1, RejectionRate: 0.5},
+		{Day: "2022-03-02", Sessions: 1, Rejected: 1, RejectionRate: 1},
+		{Day: "2022-03-03", Sessions: 1, Rejected: 1, RejectionRate: 1},
+	})
+}
+
+func TestDailyRejectionsGapDay(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {CreatedAt: "2022-03-01T10:00:00Z", RejectedAt: "2022-03-01T10:01:00Z"},
+		"s2": {CreatedAt: "2022-03-03T10:00:00Z"},
+	}
+
+	assertDays(t, dailyRejections(stats, false), []DailyStats{
+		{Day: "2022-03-01", Sessions: 1, Rejected: 1, RejectionRate: 1},
+		{Day: "2022-03-03", Sessions: 1},
+	})
+	assertDays(t, dailyRejections(stats, true), []DailyStats{
+		{Day: "2022-03-01", Sessions: 1, Rejected: 1, RejectionRate: 1},
+		{Day: "2022-03-02"},
+		{Day: "2022-03-03", Sessions: 1},
+	})
+}
+
+func TestDailyRejectionsWithoutCreatedAt(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {RejectedAt: "2022-03-01T10:01:00Z"},
+		"s2": {CreatedAt: "not a timestamp"},
+	}
+
+	if days := dailyRejections(stats, true); len(days) != 0 {
+		t.Errorf("got %d days, want none", len(days))
+	}
+}
+
+func assertDays(t *testing.T, got []*DailyStats, want []DailyStats) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d days, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("day %d = %+v, want %+v", i, *got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/gocarina/gocsv"
+
+	"scan_playground/sessionstats"
+)
+
+// Grains accepted by --group-key.
+const (
+	// GroupBySession keeps one row per session (the plain session stats output).
+	GroupBySession = "session"
+	// GroupByMarket keys rows by the session's market.
+	GroupByMarket = "market"
+	// GroupByRoleAndDay keys rows by "<CreatedByRole>/<UTC day of CreatedAt>",
+	// e.g. "USER/2022-03-01".
+	GroupByRoleAndDay = "created_by_role+day"
+)
+
+const unknownGroup = "unknown"
+
+type GroupStats struct {
+	Group          string `csv:"group" json:"group"`
+	Sessions       int    `csv:"sessions" json:"sessions"`
+	AssignAttempts int    `csv:"no_of_assign_attempts" json:"no_of_assign_attempts"`
+	Confirmed      int    `csv:"confirmed" json:"confirmed"`
+	Rejected       int    `csv:"rejected" json:"rejected"`
+	Closed         int    `csv:"closed" json:"closed"`
+}
+
+var groupKeys = map[string]func(*sessionstats.SessionStats) string{
+	GroupByMarket:     marketGroup,
+	GroupByRoleAndDay: roleAndDayGroup,
+}
+
+func orUnknown(v string) string {
+	if v == "" {
+		return unknownGroup
+	}
+
+	return v
+}
+
+func marketGroup(s *sessionstats.SessionStats) string {
+	return orUnknown(s.Market)
+}
+
+func roleAndDayGroup(s *sessionstats.SessionStats) string {
+	day := unknownGroup
+	if createdAt, err := time.Parse(time.RFC3339, s.CreatedAt); err == nil {
+		day = createdAt.UTC().Format(dayLayout)
+	}
+
+	return orUnknown(s.CreatedByRole) + "/" + day
+}
+
+// groupStats aggregates sessions into one row per key, summing the assign
+// attempts and counting sessions that reached each terminal timestamp.
+// Rows are ordered by group.
+func groupStats(statsMap map[string]*sessionstats.SessionStats, key func(*sessionstats.SessionStats) string) []*GroupStats {
+	groups := make(map[string]*GroupStats)
+
+	for _, s := range statsMap {
+		k := key(s)
+		g, ok := groups[k]
+		if !ok {
+			g = &GroupStats{Group: k}
+			groups[k] = g
+		}
+
+		g.Sessions++
+		g.AssignAttempts += s.NoOfAssignAttempts
+		if s.ConfirmedAt != "" {
+			g.Confirmed++
+		}
+		if s.RejectedAt != "" {
+			g.Rejected++
+		}
+		if s.ClosedAt != "" {
+			g.Closed++
+		}
+	}
+
+	rows := make([]*GroupStats, 0, len(groups))
+	for _, g := range groups {
+		rows = append(rows, g)
+	}
+
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Group < rows[j].Group })
+
+	return rows
+}
+
+func marshalGroupsToCSV(w io.Writer, groups []*GroupStats) error {
+	return gocsv.Marshal(&groups, w)
+}
+
+func marshalGroupsToJSONL(w io.Writer, groups []*GroupStats) error {
+	enc := json.NewEncoder(w)
+
+	for _, g := range groups {
+		if err := enc.Encode(g); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func TestGroupStatsByMarket(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {Market: "pl", NoOfAssignAttempts: 2, ConfirmedAt: "t", ClosedAt: "t"},
+		"s2": {Market: "pl", NoOfAssignAttempts: 1, RejectedAt: "t"},
+		"s3": {Market: "us", NoOfAssignAttempts: 3, ConfirmedAt: "t"},
+		"s4": {NoOfAssignAttempts: 1},
+	}
+
+	got := groupStats(stats, groupKeys[GroupByMarket])
+
+	want := []GroupStats{
+		{Group: "pl", Sessions: 2, AssignAttempts: 3, Confirmed: 1, Rejected: 1, Closed: 1},
+		{Group: unknownGroup, Sessions: 1, AssignAttempts: 1},
+		{Group: "us", Sessions: 1, AssignAttempts: 3, Confirmed: 1},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d rows, want one per market: %+v", len(got), got)
+	}
+	for i := range want {
+		if *got[i] != want[i] {
+			t.Errorf("row %d = %+v, want %+v", i, *got[i], want[i])
+		}
+	}
+}
+
+func TestRoleAndDayGroup(t *testing.T) {
+	tests := []struct {
+		stats sessionstats.SessionStats
+		want  string
+	}{
+		{stats: sessionstats.SessionStats{CreatedByRole: "USER", CreatedAt: "2022-03-01T10:00:00Z"}, want: "USER/2022-03-01"},
+		{stats: sessionstats.SessionStats{CreatedByRole: "TUTOR", CreatedAt: "2022-03-01T23:30:00-02:00"}, want: "TUTOR/2022-03-02"},
+		{stats: sessionstats.SessionStats{ConfirmedAt: "2022-03-01T10:00:00Z"}, want: "unknown/unknown"},
+	}
+
+	for _, tt := range tests {
+		if got := roleAndDayGroup(&tt.stats); got != tt.want {
+			t.Errorf("roleAndDayGroup(%+v) = %q, want %q", tt.stats, got, tt.want)
+		}
+	}
+}
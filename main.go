@@ -2,162 +2,536 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	"github.com/gocarina/gocsv"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"scan_playground/sessionstats"
+)
+
+// Build metadata, injected at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
 )
 
-type SessionStats struct {
-	ID                 string `csv:"id"`
-	Market             string `csv:"market"`
-	NoOfAssignAttempts int    `csv:"no_of_assign_attempts"`
-	CreatedAt          string `csv:"created_at"`
-	CreatedByRole      string `csv:"created_by_role"`
-	RejectedAt         string `csv:"rejected_at"`
-	RejectedReason     string `csv:"rejected_reason"`
-	ClosedAt           string `csv:"closed_at"`
-	ClosedReason       string `csv:"closed_reason"`
-	ConfirmedAt        string `csv:"confirmed_at"`
+// unknownMetadataSummary describes the items skipped because of unknown
+// metadata, given their count per event type, most frequent first.
+func unknownMetadataSummary(unknown map[string]int) string {
+	prefixes := make([]string, 0, len(unknown))
+	total := 0
+	for prefix, n := range unknown {
+		prefixes = append(prefixes, prefix)
+		total += n
+	}
+
+	sort.Slice(prefixes, func(i, j int) bool {
+		if unknown[prefixes[i]] != unknown[prefixes[j]] {
+			return unknown[prefixes[i]] > unknown[prefixes[j]]
+		}
+		return prefixes[i] < prefixes[j]
+	})
+
+	described := make([]string, len(prefixes))
+	for i, prefix := range prefixes {
+		described[i] = fmt.Sprintf("%s (%d)", prefix, unknown[prefix])
+	}
+
+	return fmt.Sprintf("skipped %d items with %d unknown metadata types: %s", total, len(prefixes), strings.Join(described, ", "))
 }
 
-type DynamoItem struct {
-	ID        string `dynamodbav:"id"`
-	Metadata  string `dynamodbav:"metadata"`
-	CreatedAt string `dynamodbav:"createdAt"`
-	Market    string `dynamodbav:"market"`
+// defaultWindow is how far back the scan reaches when --from isn't given.
+const defaultWindow = 30 * 24 * time.Hour
+
+// parseWindow parses the --from/--to flag values, defaulting to to now and
+// from to defaultWindow before to, and checks that from is before to.
+func parseWindow(fromFlag, toFlag string, now time.Time) (from, to time.Time, err error) {
+	to = now
+	if toFlag != "" {
+		if to, err = time.Parse(time.RFC3339, toFlag); err != nil {
+			return from, to, fmt.Errorf("invalid --to %q: %w", toFlag, err)
+		}
+	}
+
+	from = to.Add(-defaultWindow)
+	if fromFlag != "" {
+		if from, err = time.Parse(time.RFC3339, fromFlag); err != nil {
+			return from, to, fmt.Errorf("invalid --from %q: %w", fromFlag, err)
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("--from %s must be before --to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	return from, to, nil
+}
+
+// regionFromEnv returns the region from AWS_REGION or AWS_DEFAULT_REGION.
+func regionFromEnv() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// localRegion is used with a custom endpoint when no region is configured;
+// DynamoDB Local accepts any region but the SDK requires one.
+const localRegion = "us-east-1"
+
+// maxRetryBackoff caps the exponential backoff between retries of a request.
+const maxRetryBackoff = 30 * time.Second
+
+type awsOptions struct {
+	Region string
+	// EndpointURL redirects DynamoDB calls, e.g. to DynamoDB Local at
+	// http://localhost:8000. If no credentials are configured in the
+	// environment, dummy static ones are used since a local endpoint
+	// ignores them.
+	EndpointURL string
+	// MaxAttempts is how many times a request is tried, including the first
+	// attempt, before its error stops the run.
+	MaxAttempts int
+}
+
+// noRetryQuota is a retry.RateLimiter that never runs out. The standard
+// retryer's default quota gives up on retries after a few dozen throttled
+// requests across the client, long before --max-attempts is used up by a
+// parallel scan that is being throttled for a while.
+type noRetryQuota struct{}
+
+func (noRetryQuota) GetToken(context.Context, uint) (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (noRetryQuota) AddTokens(uint) error { return nil }
+
+// loadAWSConfig loads the default SDK config adjusted by opts. Throttling and
+// other transient errors are retried with exponential backoff with jitter,
+// without a client-wide retry quota.
+func loadAWSConfig(ctx context.Context, awsOpts awsOptions) (aws.Config, error) {
+	region, endpointURL := awsOpts.Region, awsOpts.EndpointURL
+
+	opts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = awsOpts.MaxAttempts
+				o.MaxBackoff = maxRetryBackoff
+				o.RateLimiter = noRetryQuota{}
+			})
+		}),
+	}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	if endpointURL != "" {
+		if region == "" {
+			opts = append(opts, config.WithRegion(localRegion))
+		}
+
+		opts = append(opts, config.WithEndpointResolverWithOptions(aws.EndpointResolverWithOptionsFunc(
+			func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+				if service == dynamodb.ServiceID {
+					return aws.Endpoint{URL: endpointURL, SigningRegion: region}, nil
+				}
+				return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+			})))
+
+		if os.Getenv("AWS_ACCESS_KEY_ID") == "" && os.Getenv("AWS_PROFILE") == "" {
+			opts = append(opts, config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider("local", "local", "")))
+		}
+	}
+
+	return config.LoadDefaultConfig(ctx, opts...)
 }
 
+// Sources accepted by --source.
 const (
-	SessionMetadata                                      = "SESSION"
-	SessionCreatedByUserEvent                            = "DOMAINEVENT#SessionCreatedByUser"
-	SessionCreatedByTutorEvent                           = "DOMAINEVENT#SessionCreatedByTutor"
-	SessionConfirmedByTutorEvent                         = "DOMAINEVENT#SessionConfirmedByTutor"
-	SessionRejectedByUserEvent                           = "DOMAINEVENT#SessionRejectedByUser"
-	SessionRejectedOnMatchingTimeoutEvent                = "DOMAINEVENT#SessionRejectedOnMatchingTimeout"
-	SessionRejectedOnNoTutorsEvent                       = "DOMAINEVENT#SessionRejectedOnNoTutors"
-	SessionClosedByUserEvent                             = "DOMAINEVENT#SessionClosedByUser"
-	SessionClosedByTutorEvent                            = "DOMAINEVENT#SessionClosedByTutor"
-	SessionClosedOnTutorDisconnectedEvent                = "DOMAINEVENT#SessionClosedOnTutorDisconnected"
-	SessionRatedByUserEvent                              = "DOMAINEVENT#SessionRatedByUser"
-	SessionReportedByTutorEvent                          = "DOMAINEVENT#SessionReportedByTutor"
-	QuestionUpdatedEvent                                 = "DOMAINEVENT#QuestionUpdated"
-	TutorUnassignedFromSessionOnConfirmationTimeoutEvent = "DOMAINEVENT#TutorUnassignedFromSessionOnConfirmationTimeout"
-	TutorUnassignedFromSessionOnTutorDisconnectedEvent   = "DOMAINEVENT#TutorUnassignedFromSessionOnTutorDisconnected"
-	TutorAssignedToSessionEvent                          = "DOMAINEVENT#TutorAssignedToSession"
+	// SourceScan reads the live table with a (parallel) Scan.
+	SourceScan = "scan"
+	// SourceS3Export reads a DynamoDB point-in-time export (DYNAMODB_JSON,
+	// gzipped) from S3.
+	SourceS3Export = "s3-export"
 )
 
-func fillStatBasedOnItem(stats *SessionStats, item DynamoItem) {
-	switch {
-	case strings.HasPrefix(item.Metadata, SessionMetadata):
-		stats.Market = item.Market
-	case strings.HasPrefix(item.Metadata, SessionCreatedByUserEvent):
-		stats.CreatedAt = item.CreatedAt
-		stats.CreatedByRole = "USER"
-	case strings.HasPrefix(item.Metadata, SessionCreatedByTutorEvent):
-		stats.CreatedAt = item.CreatedAt
-		stats.CreatedByRole = "TUTOR"
-	case strings.HasPrefix(item.Metadata, SessionConfirmedByTutorEvent):
-		stats.ConfirmedAt = item.CreatedAt
-	case strings.HasPrefix(item.Metadata, SessionRejectedByUserEvent):
-		stats.RejectedAt = item.CreatedAt
-		stats.RejectedReason = "user"
-	case strings.HasPrefix(item.Metadata, SessionRejectedOnMatchingTimeoutEvent):
-		stats.RejectedAt = item.CreatedAt
-		stats.RejectedReason = "matching_timeout"
-	case strings.HasPrefix(item.Metadata, SessionRejectedOnNoTutorsEvent):
-		stats.RejectedAt = item.CreatedAt
-		stats.RejectedReason = "no_tutors"
-	case strings.HasPrefix(item.Metadata, SessionClosedByTutorEvent):
-		stats.ClosedAt = item.CreatedAt
-		stats.ClosedReason = "tutor"
-	case strings.HasPrefix(item.Metadata, SessionClosedByUserEvent):
-		stats.ClosedAt = item.CreatedAt
-		stats.ClosedReason = "user"
-	case strings.HasPrefix(item.Metadata, SessionClosedOnTutorDisconnectedEvent):
-		stats.ClosedAt = item.CreatedAt
-		stats.ClosedReason = "tutor_disconnected"
-	case strings.HasPrefix(item.Metadata, TutorAssignedToSessionEvent):
-		stats.NoOfAssignAttempts += 1
-	case strings.HasPrefix(item.Metadata, SessionRatedByUserEvent):
-	case strings.HasPrefix(item.Metadata, SessionReportedByTutorEvent):
-	case strings.HasPrefix(item.Metadata, QuestionUpdatedEvent):
-	case strings.HasPrefix(item.Metadata, TutorUnassignedFromSessionOnConfirmationTimeoutEvent):
-	case strings.HasPrefix(item.Metadata, TutorUnassignedFromSessionOnTutorDisconnectedEvent):
-	default:
-		panic("Unknown item")
+// Output formats accepted by --format.
+const (
+	FormatCSV     = "csv"
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// marshalToJSONL writes one JSON object per session per line to w, using the
+// same field names as the CSV columns. Like sessionstats.MarshalToCSV it
+// streams the rows.
+func marshalToJSONL(w io.Writer, statsMap map[string]*sessionstats.SessionStats) error {
+	enc := json.NewEncoder(w)
+
+	for _, s := range sessionstats.Sorted(statsMap) {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func marshalToCSV(statsMap map[string]*SessionStats) string {
-	stats := make([]*SessionStats, 0, len(statsMap))
+func versionString() string {
+	return fmt.Sprintf("sessions_stats %s (commit %s, built %s)", version, commit, date)
+}
 
-	for _, v := range statsMap {
-		stats = append(stats, v)
-	}
+// countOnlyIncompatible are the flags that filter or shape the output, which
+// --count-only doesn't build.
+var countOnlyIncompatible = []string{
+	"market", "stats-json", "output", "split", "format", "schema-comment",
+	"daily-output", "daily-zero-fill", "summary", "group-key",
+	"output-template", "output-header-template", "output-footer-template",
+}
 
-	csvContent, err := gocsv.MarshalString(stats)
-	if err != nil {
-		panic(err)
+// countOnlyConflict returns the name of the first flag of
+// countOnlyIncompatible set on fs, or "" when there is none.
+func countOnlyConflict(fs *flag.FlagSet) string {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, name := range countOnlyIncompatible {
+		if set[name] {
+			return name
+		}
 	}
 
-	return csvContent
+	return ""
 }
 
 func main() {
-	cfg, err := config.LoadDefaultConfig(context.TODO(), func(o *config.LoadOptions) error {
-		o.Region = "eu-west-1"
-		return nil
-	})
+	showVersion := flag.Bool("version", false, "print version information and exit")
+	source := flag.String("source", SourceScan, "where to read events from: scan (the live table) or s3-export (a DynamoDB export in S3)")
+	table := flag.String("table", "", "DynamoDB table holding the session events (required with --source scan)")
+	exportPrefix := flag.String("export-prefix", "", "s3://bucket/prefix of the export's .json.gz data files (required with --source s3-export)")
+	region := flag.String("region", "", "AWS region of the table (default $AWS_REGION, then $AWS_DEFAULT_REGION)")
+	fromFlag := flag.String("from", "", "start of the scan window, RFC3339 (default 30 days before --to)")
+	toFlag := flag.String("to", "", "end of the scan window, RFC3339 (default now)")
+	timeSource := flag.String("time-source", sessionstats.TimeSourceIngestion, "timestamp used for the window filter and time columns: event or ingestion")
+	outputTemplate := flag.String("output-template", "", "text/template file rendered once per session instead of CSV output, e.g. {{.ID}},{{value .Rating}} (value renders unset numbers as empty)")
+	headerTemplate := flag.String("output-header-template", "", "text/template file rendered once before the rows, used with --output-template")
+	footerTemplate := flag.String("output-footer-template", "", "text/template file rendered once after the rows, used with --output-template")
+	dailyOutput := flag.String("daily-output", "", "file to write the per-day session count and rejection rate CSV to")
+	statsJSON := flag.String("stats-json", "", "file to write a JSON summary of the run to: session and confirmed counts, reject and close reasons, assign attempts distribution")
+	dailyZeroFill := flag.Bool("daily-zero-fill", false, "emit days without sessions as zero rows in --daily-output")
+	keyRangeStart := flag.String("key-range-start", "", "only keep sessions whose id is >= this value (filtered after the read, the whole table is still scanned)")
+	keyRangeEnd := flag.String("key-range-end", "", "only keep sessions whose id is < this value, compared as strings, so the end is exclusive: ids starting with 8 through f are --key-range-start 8 --key-range-end g (filtered after the read, the whole table is still scanned)")
+	withSchemaComment := flag.Bool("schema-comment", false, "prefix the CSV output with a # line listing column:type pairs (ignored with --output-template)")
+	groupKey := flag.String("group-key", GroupBySession, "output grain: session, market or created_by_role+day")
+	format := flag.String("format", FormatCSV, "output format: csv, jsonl or parquet")
+	output := flag.String("output", "", "destination of the export: a local path or s3://bucket/key (default stdout)")
+	segments := flag.Int("segments", 1, "number of parallel scan segments")
+	summary := flag.Bool("summary", false, "print a per-market summary to stderr after the export")
+	endpointURL := flag.String("endpoint-url", "", "custom DynamoDB endpoint, e.g. http://localhost:8000 for DynamoDB Local")
+	maxAttempts := flag.Int("max-attempts", 10, "attempts per AWS request, including the first, before a throttling or transient error fails the run")
+	strict := flag.Bool("strict", false, "fail instead of warning when a timestamp can't be parsed as RFC3339")
+	progress := flag.Bool("progress", false, "print scan progress to stderr every few seconds")
+	market := flag.String("market", "", "only export sessions of this market (filtered after the scan)")
+	timeout := flag.Duration("timeout", 0, "stop scanning after this long and write what was collected (default no limit)")
+	checkpointFile := flag.String("checkpoint-file", "", "save the scan position and the sessions collected so far to this file every few seconds and when the scan stops")
+	resume := flag.Bool("resume", false, "continue the scan saved in --checkpoint-file, if the file exists, instead of starting over")
+	mappingFile := flag.String("mapping-file", "", "JSON file mapping metadata prefixes to the stats they feed, for tables with a different event catalog (default the production events)")
+	split := flag.String("split", "", "write one output per calendar month (UTC) of the window instead of one for all of it: \"monthly\"; files are named after --output with -YYYY-MM inserted before the extension, by creation month")
+	logLevel := flag.String("log-level", "info", "minimum level of the diagnostics logged to stderr: debug, info, warn or error")
+	countOnly := flag.Bool("count-only", false, "run the scan but only print the number of items and distinct sessions it covers, writing no output")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --log-level %q: must be debug, info, warn or error\n", *logLevel)
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	switch *source {
+	case SourceScan:
+		if *table == "" {
+			fmt.Fprintln(os.Stderr, "--table is required")
+			os.Exit(2)
+		}
+	case SourceS3Export:
+		if _, _, err := parseS3URL(*exportPrefix); err != nil {
+			fmt.Fprintf(os.Stderr, "--source %s needs --export-prefix: %v\n", SourceS3Export, err)
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --source %q: must be %q or %q\n", *source, SourceScan, SourceS3Export)
+		os.Exit(2)
+	}
+	if *region == "" {
+		*region = regionFromEnv()
+	}
+
+	from, to, err := parseWindow(*fromFlag, *toFlag, time.Now())
 	if err != nil {
-		panic(err)
-	}
-
-	svc := dynamodb.NewFromConfig(cfg)
-	p := dynamodb.NewScanPaginator(svc, &dynamodb.ScanInput{
-		TableName:        aws.String("session"),
-		FilterExpression: aws.String("#createdAt > :createdAtFrom AND #createdAt < :createdAtTo AND (#metadata = :sessMeta OR begins_with(#metadata, :domainEventMeta))"),
-		ExpressionAttributeValues: map[string]types.AttributeValue{
-			":createdAtFrom":   &types.AttributeValueMemberS{Value: "2022-03-01T00:00:00Z"},
-			":createdAtTo":     &types.AttributeValueMemberS{Value: "2022-04-01T00:00:00Z"},
-			":sessMeta":        &types.AttributeValueMemberS{Value: "SESSION"},
-			":domainEventMeta": &types.AttributeValueMemberS{Value: "DOMAINEVENT#"},
-		},
-		ExpressionAttributeNames: map[string]string{
-			"#createdAt": "createdAt",
-			"#metadata":  "metadata",
-		},
-		ProjectionExpression: aws.String("id,metadata,createdAt,market"),
-	})
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	stats := make(map[string]*SessionStats)
+	if *timeSource != sessionstats.TimeSourceEvent && *timeSource != sessionstats.TimeSourceIngestion {
+		fmt.Fprintf(os.Stderr, "invalid --time-source %q: must be %q or %q\n", *timeSource, sessionstats.TimeSourceEvent, sessionstats.TimeSourceIngestion)
+		os.Exit(2)
+	}
+	if *keyRangeStart != "" && *keyRangeEnd != "" && *keyRangeStart >= *keyRangeEnd {
+		fmt.Fprintf(os.Stderr, "--key-range-start %q must sort before --key-range-end %q\n", *keyRangeStart, *keyRangeEnd)
+		os.Exit(2)
+	}
+
+	if *maxAttempts < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --max-attempts %d: must be at least 1\n", *maxAttempts)
+		os.Exit(2)
+	}
+	if *segments < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --segments %d: must be at least 1\n", *segments)
+		os.Exit(2)
+	}
+
+	groupKeyFn, ok := groupKeys[*groupKey]
+	if !ok && *groupKey != GroupBySession {
+		fmt.Fprintf(os.Stderr, "invalid --group-key %q: must be %q, %q or %q\n", *groupKey, GroupBySession, GroupByMarket, GroupByRoleAndDay)
+		os.Exit(2)
+	}
+	if groupKeyFn != nil && *outputTemplate != "" {
+		fmt.Fprintln(os.Stderr, "--output-template renders sessions and can't be combined with --group-key")
+		os.Exit(2)
+	}
+
+	if *format != FormatCSV && *format != FormatJSONL && *format != FormatParquet {
+		fmt.Fprintf(os.Stderr, "invalid --format %q: must be %q, %q or %q\n", *format, FormatCSV, FormatJSONL, FormatParquet)
+		os.Exit(2)
+	}
+	if *format == FormatParquet && *output == "" {
+		fmt.Fprintln(os.Stderr, "--format parquet writes a binary file and needs --output")
+		os.Exit(2)
+	}
+	if *withSchemaComment && *format != FormatCSV {
+		fmt.Fprintln(os.Stderr, "--schema-comment is only supported with --format csv")
+		os.Exit(2)
+	}
+
+	if *countOnly {
+		if name := countOnlyConflict(flag.CommandLine); name != "" {
+			fmt.Fprintf(os.Stderr, "--%s needs the full session stats and can't be combined with --count-only\n", name)
+			os.Exit(2)
+		}
+	}
+
+	if *split != "" && *split != SplitMonthly {
+		fmt.Fprintf(os.Stderr, "invalid --split %q: must be %q\n", *split, SplitMonthly)
+		os.Exit(2)
+	}
+	if *split != "" && *output == "" {
+		fmt.Fprintln(os.Stderr, "--split writes one file per window and needs --output to name them")
+		os.Exit(2)
+	}
 
-	for p.HasMorePages() {
-		out, err := p.NextPage(context.TODO())
+	if *resume && *checkpointFile == "" {
+		fmt.Fprintln(os.Stderr, "--resume needs --checkpoint-file")
+		os.Exit(2)
+	}
+	if *checkpointFile != "" && (*source != SourceScan || *countOnly) {
+		fmt.Fprintf(os.Stderr, "--checkpoint-file only works with --source %s and without --count-only\n", SourceScan)
+		os.Exit(2)
+	}
+
+	if strings.HasPrefix(*output, s3Scheme) {
+		if _, _, err := parseS3URL(*output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	var templates *rowTemplates
+	if *outputTemplate == "" && (*headerTemplate != "" || *footerTemplate != "") {
+		fmt.Fprintln(os.Stderr, "--output-header-template and --output-footer-template require --output-template")
+		os.Exit(2)
+	}
+	var mappings []sessionstats.EventMapping
+	if *mappingFile != "" {
+		mappings, err = sessionstats.LoadEventMappings(*mappingFile)
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(os.Stderr, "invalid --mapping-file: %v\n", err)
+			os.Exit(2)
 		}
+	}
 
-		var pItems []DynamoItem
-		err = attributevalue.UnmarshalListOfMaps(out.Items, &pItems)
+	if *outputTemplate != "" {
+		templates, err = loadRowTemplates(*outputTemplate, *headerTemplate, *footerTemplate)
 		if err != nil {
-			panic(err)
+			fmt.Fprintf(os.Stderr, "invalid output template: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// Interrupting the run stops the scan but still writes what was collected.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	cfg, err := loadAWSConfig(ctx, awsOptions{
+		Region:      *region,
+		EndpointURL: *endpointURL,
+		MaxAttempts: *maxAttempts,
+	})
+	if err != nil {
+		fatal("loading AWS config failed", err)
+	}
+
+	var progressOut io.Writer
+	if *progress {
+		progressOut = os.Stderr
+	}
+
+	opts := sessionstats.Options{
+		Table:          *table,
+		From:           from,
+		To:             to,
+		TimeSource:     *timeSource,
+		KeyRangeStart:  *keyRangeStart,
+		KeyRangeEnd:    *keyRangeEnd,
+		Market:         *market,
+		Segments:       *segments,
+		Mappings:       mappings,
+		CountOnly:      *countOnly,
+		Progress:       progressOut,
+		CheckpointFile: *checkpointFile,
+		Resume:         *resume,
+	}
+
+	var res *sessionstats.Result
+	if *source == SourceS3Export {
+		bucket, prefix, _ := parseS3URL(*exportPrefix)
+		res, err = sessionstats.CollectFromExport(ctx, s3.NewFromConfig(cfg), bucket, prefix, opts)
+	} else {
+		res, err = sessionstats.Collect(ctx, dynamodb.NewFromConfig(cfg), opts)
+	}
+	if err != nil {
+		if res == nil || ctx.Err() == nil {
+			fatal("scan failed", err)
+		}
+		slog.Warn("scan stopped early, writing the sessions collected so far", "reason", ctx.Err(), "sessions", res.Sessions)
+	}
+	if *countOnly {
+		fmt.Printf("items: %d\nsessions: %d\n", res.Items, res.Sessions)
+		if len(res.ItemErrors) > 0 {
+			slog.Warn("malformed items were counted but not attributed to a session", "items", len(res.ItemErrors))
+		}
+		return
+	}
+	// From here on a second signal kills the process as usual; the output is
+	// written with a fresh context so a cancelled scan can still be flushed.
+	stop()
+	stats := res.Stats
+	timestampErrors := res.TimestampErrors
+
+	if len(timestampErrors) > 0 {
+		level := slog.LevelWarn
+		if *strict {
+			level = slog.LevelError
 		}
 
-		for _, item := range pItems {
-			_, ok := stats[item.ID]
-			if !ok {
-				stats[item.ID] = &SessionStats{ID: item.ID}
+		slog.Log(context.Background(), level, "unparseable timestamps were cleared", "count", len(timestampErrors))
+		for _, err := range timestampErrors {
+			slog.Log(context.Background(), level, "unparseable timestamp", "err", err)
+		}
+
+		if *strict {
+			os.Exit(1)
+		}
+	}
+
+	if len(res.UnknownMetadata) > 0 {
+		slog.Warn(unknownMetadataSummary(res.UnknownMetadata))
+	}
+
+	if len(res.ItemErrors) > 0 {
+		slog.Warn("skipped malformed items", "count", len(res.ItemErrors))
+		for _, err := range res.ItemErrors {
+			slog.Warn("malformed item", "err", err)
+		}
+	}
+
+	if res.OffsetTimestamps > 0 {
+		slog.Warn("items have createdAt with a non-Z offset; the date filter compares strings, so items near the window bounds may have been missed or wrongly included", "items", res.OffsetTimestamps)
+	}
+
+	if *dailyOutput != "" {
+		if err := writeDailyCSV(*dailyOutput, dailyRejections(stats, *dailyZeroFill)); err != nil {
+			fatal("writing the daily output failed", err)
+		}
+	}
+
+	if *statsJSON != "" {
+		if err := writeStatsJSON(*statsJSON, summarizeRun(stats)); err != nil {
+			fatal("writing the stats JSON failed", err)
+		}
+	}
+
+	outOpts := outputOptions{
+		Format:        *format,
+		SchemaComment: *withSchemaComment,
+		GroupKey:      groupKeyFn,
+		Templates:     templates,
+	}
+	if *split == "" {
+		n, err := exportTo(context.Background(), cfg, *output, stats, outOpts)
+		if err != nil {
+			fatal("writing the output failed", err)
+		}
+		slog.Info("export written", "bytes", n, "output", outputName(*output))
+	} else {
+		windows := monthlyWindows(from, to)
+		for i, bucket := range splitByWindow(stats, windows) {
+			dest := windowDest(*output, windows[i])
+			n, err := exportTo(context.Background(), cfg, dest, bucket, outOpts)
+			if err != nil {
+				fatal("writing the output failed", err)
 			}
+			slog.Info("export written", "bytes", n, "output", dest, "sessions", len(bucket))
+		}
+	}
 
-			fillStatBasedOnItem(stats[item.ID], item)
+	if *summary {
+		if err := writeSummary(os.Stderr, summarizeByMarket(stats)); err != nil {
+			fatal("writing the summary failed", err)
 		}
 	}
+}
 
-	fmt.Println(marshalToCSV(stats))
+// fatal logs err as the reason the run failed and exits with status 1.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestLoadAWSConfigEndpointURL(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_PROFILE", "")
+
+	cfg, err := loadAWSConfig(context.Background(), awsOptions{EndpointURL: "http://localhost:8000", MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint, err := cfg.EndpointResolverWithOptions.ResolveEndpoint(dynamodb.ServiceID, cfg.Region)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.URL != "http://localhost:8000" {
+		t.Errorf("DynamoDB endpoint = %q, want http://localhost:8000", endpoint.URL)
+	}
+
+	if _, err := cfg.EndpointResolverWithOptions.ResolveEndpoint("S3", cfg.Region); err == nil {
+		t.Error("expected other services to fall back to the default endpoints")
+	}
+
+	creds, err := cfg.Credentials.Retrieve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKeyID != "local" {
+		t.Errorf("access key = %q, want dummy local credentials", creds.AccessKeyID)
+	}
+}
+
+func TestLoadAWSConfigMaxAttempts(t *testing.T) {
+	cfg, err := loadAWSConfig(context.Background(), awsOptions{Region: "eu-west-1", MaxAttempts: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := cfg.Retryer().MaxAttempts(); got != 7 {
+		t.Errorf("retryer max attempts = %d, want 7", got)
+	}
+}
+
+func TestLoadAWSConfigRetriesWithoutQuota(t *testing.T) {
+	cfg, err := loadAWSConfig(context.Background(), awsOptions{Region: "eu-west-1", MaxAttempts: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retryer := cfg.Retryer()
+	throttled := errors.New("ProvisionedThroughputExceededException")
+	for i := 0; i < 200; i++ {
+		if _, err := retryer.GetRetryToken(context.Background(), throttled); err != nil {
+			t.Fatalf("retry %d refused: %v", i+1, err)
+		}
+	}
+}
+
+func TestCountOnlyConflict(t *testing.T) {
+	newFlags := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("sessions_stats", flag.ContinueOnError)
+		fs.Bool("count-only", false, "")
+		fs.String("table", "", "")
+		for _, name := range countOnlyIncompatible {
+			fs.String(name, "", "")
+		}
+		return fs
+	}
+
+	for _, name := range countOnlyIncompatible {
+		t.Run(name, func(t *testing.T) {
+			fs := newFlags()
+			if err := fs.Parse([]string{"--count-only", "--table", "sessions", "--" + name, "x"}); err != nil {
+				t.Fatal(err)
+			}
+			if got := countOnlyConflict(fs); got != name {
+				t.Errorf("countOnlyConflict = %q, want %q", got, name)
+			}
+		})
+	}
+
+	fs := newFlags()
+	if err := fs.Parse([]string{"--count-only", "--table", "sessions"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := countOnlyConflict(fs); got != "" {
+		t.Errorf("countOnlyConflict = %q without output flags, want none", got)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	now := time.Date(2022, 3, 31, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		from, to string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			wantFrom: now.Add(-defaultWindow),
+			wantTo:   now,
+		},
+		{
+			name:     "from defaults to 30 days before to",
+			to:       "2022-03-01T00:00:00Z",
+			wantFrom: time.Date(2022, 1, 30, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "both given",
+			from:     "2022-02-01T00:00:00Z",
+			to:       "2022-03-01T00:00:00+01:00",
+			wantFrom: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 2, 28, 23, 0, 0, 0, time.UTC),
+		},
+		{name: "to before from", from: "2022-03-01T00:00:00Z", to: "2022-02-01T00:00:00Z", wantErr: true},
+		{name: "empty window", from: "2022-03-01T00:00:00Z", to: "2022-03-01T00:00:00Z", wantErr: true},
+		{name: "from after now", from: "2022-04-01T00:00:00Z", wantErr: true},
+		{name: "malformed from", from: "2022-03-01", wantErr: true},
+		{name: "malformed to", to: "2022-03-01 00:00:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to, err := parseWindow(tt.from, tt.to, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got window %s - %s, want an error", from, to)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+				t.Errorf("window = %s - %s, want %s - %s", from, to, tt.wantFrom, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestVersionString(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "v1.2.3", "abc123", "2022-03-01"
+
+	want := "sessions_stats v1.2.3 (commit abc123, built 2022-03-01)"
+	if got := versionString(); got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+}
+
+// TestVersionFlag runs main in a subprocess: --version has to print and exit 0
+// before any flag validation or AWS setup, which would fail here as no table
+// and no AWS configuration are given.
+func TestVersionFlag(t *testing.T) {
+	if os.Getenv("SESSIONS_STATS_RUN_MAIN") == "1" {
+		os.Args = []string{"sessions_stats", "--version"}
+		main()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVersionFlag$")
+	cmd.Env = append(os.Environ(),
+		"SESSIONS_STATS_RUN_MAIN=1",
+		"AWS_CONFIG_FILE=/nonexistent",
+		"AWS_SHARED_CREDENTIALS_FILE=/nonexistent",
+		"AWS_PROFILE=missing",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("--version failed: %v\n%s", err, out)
+	}
+
+	if got := strings.SplitN(string(out), "\n", 2)[0]; got != versionString() {
+		t.Errorf("--version printed %q, want %q", got, versionString())
+	}
+}
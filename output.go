@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"scan_playground/sessionstats"
+)
+
+const s3Scheme = "s3://"
+
+// parseS3URL splits an s3://bucket/key destination into its bucket and key.
+func parseS3URL(dest string) (bucket, key string, err error) {
+	path := strings.TrimPrefix(dest, s3Scheme)
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid S3 destination %q: expected s3://bucket/key", dest)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// output is an export destination. Close finishes the write; for S3 it waits
+// for the upload. Abort gives up on it instead, so that a failed render
+// doesn't leave a truncated export behind for downstream loaders.
+type output interface {
+	io.WriteCloser
+	Abort(err error) error
+}
+
+// openOutput returns the writer for the export destination: stdout when dest
+// is empty, an S3 object when it starts with s3://, a local file otherwise.
+func openOutput(ctx context.Context, cfg aws.Config, dest string) (output, error) {
+	switch {
+	case dest == "":
+		return nopWriteCloser{os.Stdout}, nil
+	case strings.HasPrefix(dest, s3Scheme):
+		bucket, key, err := parseS3URL(dest)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Writer(ctx, manager.NewUploader(s3.NewFromConfig(cfg)), bucket, key), nil
+	default:
+		f, err := os.Create(dest)
+		if err != nil {
+			return nil, err
+		}
+		return fileOutput{f}, nil
+	}
+}
+
+func outputName(dest string) string {
+	if dest == "" {
+		return "stdout"
+	}
+
+	return dest
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Abort can't take back what was already written to stdout.
+func (nopWriteCloser) Abort(error) error { return nil }
+
+type fileOutput struct {
+	*os.File
+}
+
+// Abort closes and removes the partial file.
+func (f fileOutput) Abort(error) error {
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// s3Writer streams everything written to it into a multipart S3 upload
+// through a pipe, so the export never has to be buffered whole.
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newS3Writer(ctx context.Context, uploader *manager.Uploader, bucket, key string) *s3Writer {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		_, err := uploader.Upload(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   pr,
+		})
+		// Unblock any pending Write if the upload gave up early.
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
+
+// Abort fails the upload body with err, which makes the uploader abort the
+// multipart upload (or skip the single PutObject) instead of completing an
+// object from what was written so far. It returns once the upload gave up.
+func (w *s3Writer) Abort(err error) error {
+	w.pw.CloseWithError(err)
+	<-w.done
+	return nil
+}
+
+type outputOptions struct {
+	Format        string
+	SchemaComment bool
+	// GroupKey, when set, aggregates the sessions into GroupStats rows.
+	GroupKey func(*sessionstats.SessionStats) string
+	// Templates, when set, replace Format for rendering the sessions.
+	Templates *rowTemplates
+}
+
+// writeResults renders the collected stats to w according to opts.
+func writeResults(w io.Writer, stats map[string]*sessionstats.SessionStats, opts outputOptions) error {
+	if opts.Templates != nil {
+		return opts.Templates.execute(w, sessionstats.Sorted(stats))
+	}
+
+	if opts.GroupKey != nil {
+		groups := groupStats(stats, opts.GroupKey)
+		if opts.Format == FormatParquet {
+			return marshalToParquet(w, groups)
+		}
+		if opts.Format == FormatJSONL {
+			return marshalGroupsToJSONL(w, groups)
+		}
+
+		if opts.SchemaComment {
+			if _, err := fmt.Fprintln(w, schemaComment(GroupStats{})); err != nil {
+				return err
+			}
+		}
+
+		return marshalGroupsToCSV(w, groups)
+	}
+
+	if opts.Format == FormatParquet {
+		return marshalToParquet(w, sessionstats.Sorted(stats))
+	}
+	if opts.Format == FormatJSONL {
+		return marshalToJSONL(w, stats)
+	}
+
+	if opts.SchemaComment {
+		if _, err := fmt.Fprintln(w, schemaComment(sessionstats.SessionStats{})); err != nil {
+			return err
+		}
+	}
+
+	return sessionstats.MarshalToCSV(w, stats)
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportTo writes stats to dest, as openOutput resolves it, and returns the
+// number of bytes written.
+func exportTo(ctx context.Context, cfg aws.Config, dest string, stats map[string]*sessionstats.SessionStats, opts outputOptions) (int64, error) {
+	out, err := openOutput(ctx, cfg, dest)
+	if err != nil {
+		return 0, err
+	}
+
+	return writeOutput(out, stats, opts)
+}
+
+// writeOutput writes stats to out and closes it, or aborts it when rendering
+// fails, and returns the number of bytes written.
+func writeOutput(out output, stats map[string]*sessionstats.SessionStats, opts outputOptions) (int64, error) {
+	w := &countingWriter{w: out}
+
+	if err := writeResults(w, stats, opts); err != nil {
+		out.Abort(err)
+		return w.n, err
+	}
+
+	return w.n, out.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+
+	"scan_playground/sessionstats"
+)
+
+func TestMarshalToJSONL(t *testing.T) {
+	var b strings.Builder
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {ID: "s1", Market: "pl"},
+		"s2": {ID: "s2", Market: "us"},
+	}
+
+	if err := marshalToJSONL(&b, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2:\n%s", len(lines), b.String())
+	}
+
+	var row map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &row); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := row["no_of_assign_attempts"]; !ok {
+		t.Errorf("JSON keys don't match the CSV columns: %v", row)
+	}
+}
+
+func TestMarshalToJSONLOptionalColumns(t *testing.T) {
+	var b strings.Builder
+	stats := map[string]*sessionstats.SessionStats{
+		"a-missing": {ID: "a-missing"},
+		"b-zero":    {ID: "b-zero", Rating: intPtr(0), SessionDurationSeconds: intPtr(0)},
+		"c-set":     {ID: "c-set", Rating: intPtr(5), SessionDurationSeconds: intPtr(60)},
+	}
+
+	if err := marshalToJSONL(&b, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][2]interface{}{
+		"a-missing": {nil, nil},
+		"b-zero":    {0.0, 0.0},
+		"c-set":     {5.0, 60.0},
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n") {
+		var row map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatal(err)
+		}
+
+		id := row["id"].(string)
+		for i, key := range []string{"rating", "session_duration_seconds"} {
+			v, ok := row[key]
+			if !ok {
+				t.Errorf("%s: %s missing, want it present (null when unset)", id, key)
+			}
+			if v != want[id][i] {
+				t.Errorf("%s: %s = %v, want %v", id, key, v, want[id][i])
+			}
+		}
+	}
+}
+
+// fakeUploadClient records the S3 calls an Uploader makes.
+type fakeUploadClient struct {
+	mu        sync.Mutex
+	puts      int
+	completes int
+	aborts    int
+}
+
+func (c *fakeUploadClient) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if _, err := io.Copy(io.Discard, in.Body); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.puts++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *fakeUploadClient) UploadPart(_ context.Context, in *s3.UploadPartInput, _ ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	if _, err := io.Copy(io.Discard, in.Body); err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String("etag")}, nil
+}
+
+func (c *fakeUploadClient) CreateMultipartUpload(context.Context, *s3.CreateMultipartUploadInput, ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (c *fakeUploadClient) CompleteMultipartUpload(context.Context, *s3.CompleteMultipartUploadInput, ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.completes++
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (c *fakeUploadClient) AbortMultipartUpload(context.Context, *s3.AbortMultipartUploadInput, ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.aborts++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// failingTemplates renders sessions by id and fails on the one with id "zz",
+// which sorts last, so the render fails after the other rows were written.
+func failingTemplates(t *testing.T) outputOptions {
+	t.Helper()
+
+	row, err := template.New("row").Parse(`{{if eq .ID "zz"}}{{index .ID 10}}{{else}}{{.ID}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return outputOptions{Templates: &rowTemplates{row: row}}
+}
+
+func TestWriteOutputAbortsFailedS3Upload(t *testing.T) {
+	tests := []struct {
+		name string
+		// size of the rows written before the render fails
+		size      int
+		wantAbort bool
+	}{
+		{name: "single part", size: 1024},
+		// Past the first part the uploader has started a multipart upload.
+		{name: "multipart", size: int(manager.MinUploadPartSize) + 1024, wantAbort: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeUploadClient{}
+			out := newS3Writer(context.Background(), manager.NewUploader(client), "bucket", "key")
+			stats := map[string]*sessionstats.SessionStats{
+				"a":  {ID: strings.Repeat("a", tt.size)},
+				"zz": {ID: "zz"},
+			}
+
+			if _, err := writeOutput(out, stats, failingTemplates(t)); err == nil {
+				t.Fatal("expected the render error")
+			}
+
+			if client.puts != 0 || client.completes != 0 {
+				t.Errorf("an object was completed: %d puts, %d completed multipart uploads", client.puts, client.completes)
+			}
+			if (client.aborts > 0) != tt.wantAbort {
+				t.Errorf("aborted multipart uploads = %d, want abort %v", client.aborts, tt.wantAbort)
+			}
+		})
+	}
+}
+
+func TestWriteOutputCompletesS3Upload(t *testing.T) {
+	client := &fakeUploadClient{}
+	out := newS3Writer(context.Background(), manager.NewUploader(client), "bucket", "key")
+
+	if _, err := writeOutput(out, map[string]*sessionstats.SessionStats{"a": {ID: "a"}}, failingTemplates(t)); err != nil {
+		t.Fatal(err)
+	}
+	if client.puts != 1 {
+		t.Errorf("got %d puts, want 1", client.puts)
+	}
+}
+
+func TestWriteOutputRemovesFailedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := map[string]*sessionstats.SessionStats{"a": {ID: "a"}, "zz": {ID: "zz"}}
+
+	if _, err := writeOutput(fileOutput{f}, stats, failingTemplates(t)); err == nil {
+		t.Fatal("expected the render error")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("partial output left behind: stat err = %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetTypes maps Go field kinds to the parquet physical (and converted)
+// type of their column.
+var parquetTypes = map[reflect.Kind]string{
+	reflect.String:  "type=BYTE_ARRAY, convertedtype=UTF8",
+	reflect.Int:     "type=INT64",
+	reflect.Float64: "type=DOUBLE",
+	reflect.Bool:    "type=BOOLEAN",
+}
+
+type parquetField struct {
+	Tag string
+}
+
+// parquetSchema derives a parquet JSON schema from the json-tagged fields of
+// the struct type t, in field order. Pointer fields become OPTIONAL columns so
+// nil values are written as nulls; everything else is REQUIRED.
+func parquetSchema(t reflect.Type) (string, error) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	fields := make([]parquetField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		ft, repetition := f.Type, "REQUIRED"
+		if ft.Kind() == reflect.Ptr {
+			ft, repetition = ft.Elem(), "OPTIONAL"
+		}
+
+		typ, ok := parquetTypes[ft.Kind()]
+		if !ok {
+			return "", fmt.Errorf("field %s: no parquet type for %s", f.Name, ft)
+		}
+
+		fields = append(fields, parquetField{
+			Tag: fmt.Sprintf("name=%s, %s, repetitiontype=%s", name, typ, repetition),
+		})
+	}
+
+	schema, err := json.Marshal(struct {
+		Tag    string
+		Fields []parquetField
+	}{
+		Tag:    "name=parquet_go_root, repetitiontype=REQUIRED",
+		Fields: fields,
+	})
+
+	return string(schema), err
+}
+
+// marshalToParquet writes rows, a slice of json-tagged structs such as
+// []*sessionstats.SessionStats, to w as a single parquet file with a schema
+// derived from the element type. Rows are handed to the writer as their JSON
+// encoding, which is matched to the schema by name.
+func marshalToParquet(w io.Writer, rows interface{}) error {
+	schema, err := parquetSchema(reflect.TypeOf(rows).Elem())
+	if err != nil {
+		return err
+	}
+
+	pw, err := writer.NewJSONWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(rows)
+	for i := 0; i < v.Len(); i++ {
+		b, err := json.Marshal(v.Index(i).Interface())
+		if err != nil {
+			return err
+		}
+
+		if err := pw.Write(string(b)); err != nil {
+			return err
+		}
+	}
+
+	return pw.WriteStop()
+}
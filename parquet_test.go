@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"scan_playground/sessionstats"
+)
+
+func TestMarshalToParquet(t *testing.T) {
+	rows := []*sessionstats.SessionStats{
+		{ID: "s1", Market: "pl", NoOfAssignAttempts: 3, Rating: intPtr(5)},
+		{ID: "s2", Market: "us"},
+	}
+
+	var b bytes.Buffer
+	if err := marshalToParquet(&b, rows); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := buffer.NewBufferFile(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetReader(f, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.ReadStop()
+
+	if got := pr.GetNumRows(); got != 2 {
+		t.Fatalf("got %d rows, want 2", got)
+	}
+
+	// The reader renames the footer schema to Go-style names; the column
+	// names as written are kept in the schema infos.
+	types := make(map[string]parquet.Type)
+	for i, info := range pr.SchemaHandler.Infos {
+		types[info.ExName] = pr.Footer.Schema[i].GetType()
+	}
+	if types["no_of_assign_attempts"] != parquet.Type_INT64 {
+		t.Errorf("no_of_assign_attempts written as %v, want INT64", types["no_of_assign_attempts"])
+	}
+	if types["id"] != parquet.Type_BYTE_ARRAY {
+		t.Errorf("id written as %v, want BYTE_ARRAY", types["id"])
+	}
+
+	attempts, _, _, err := pr.ReadColumnByPath("parquet_go_root\x01no_of_assign_attempts", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attempts) != 2 || attempts[0] != int64(3) {
+		t.Errorf("no_of_assign_attempts values = %v, want [3 0]", attempts)
+	}
+
+	ratings, _, _, err := pr.ReadColumnByPath("parquet_go_root\x01rating", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratings) != 2 || ratings[0] != int64(5) || ratings[1] != nil {
+		t.Errorf("rating values = %v, want [5 <nil>]", ratings)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"scan_playground/sessionstats"
+)
+
+// RunStats summarizes a whole run for monitoring. Its JSON keys are parsed by
+// other jobs and must stay stable.
+type RunStats struct {
+	Sessions  int `json:"sessions"`
+	Confirmed int `json:"confirmed"`
+	// RejectedReasons and ClosedReasons count the sessions per reason. The
+	// known reasons are always present, zero when no session had them.
+	RejectedReasons map[string]int `json:"rejected_reasons"`
+	ClosedReasons   map[string]int `json:"closed_reasons"`
+	// AssignAttempts maps a NoOfAssignAttempts value to the number of
+	// sessions that had it.
+	AssignAttempts map[int]int `json:"assign_attempts"`
+}
+
+// summarizeRun computes the RunStats of the final stats map.
+func summarizeRun(statsMap map[string]*sessionstats.SessionStats) *RunStats {
+	run := &RunStats{
+		RejectedReasons: make(map[string]int),
+		ClosedReasons:   make(map[string]int),
+		AssignAttempts:  make(map[int]int),
+	}
+	for _, r := range rejectedReasons {
+		run.RejectedReasons[r] = 0
+	}
+	for _, r := range closedReasons {
+		run.ClosedReasons[r] = 0
+	}
+
+	for _, s := range statsMap {
+		run.Sessions++
+		run.AssignAttempts[s.NoOfAssignAttempts]++
+		if s.ConfirmedAt != "" {
+			run.Confirmed++
+		}
+		if s.RejectedAt != "" {
+			run.RejectedReasons[s.RejectedReason]++
+		}
+		if s.ClosedAt != "" {
+			run.ClosedReasons[s.ClosedReason]++
+		}
+	}
+
+	return run
+}
+
+func writeStatsJSON(path string, run *RunStats) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(run); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
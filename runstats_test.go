@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func TestSummarizeRun(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {ConfirmedAt: "t", ClosedAt: "t", ClosedReason: "tutor", NoOfAssignAttempts: 1},
+		"s2": {RejectedAt: "t", RejectedReason: "no_tutors", NoOfAssignAttempts: 2},
+		"s3": {RejectedAt: "t", RejectedReason: "no_tutors", NoOfAssignAttempts: 2},
+		"s4": {CreatedAt: "t"},
+	}
+
+	want := &RunStats{
+		Sessions:        4,
+		Confirmed:       1,
+		RejectedReasons: map[string]int{"user": 0, "matching_timeout": 0, "no_tutors": 2},
+		ClosedReasons:   map[string]int{"user": 0, "tutor": 1, "tutor_disconnected": 0},
+		AssignAttempts:  map[int]int{0: 1, 1: 1, 2: 2},
+	}
+
+	if got := summarizeRun(stats); !reflect.DeepEqual(got, want) {
+		t.Errorf("summarizeRun = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteStatsJSONKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+	if err := writeStatsJSON(path, summarizeRun(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"sessions", "confirmed", "rejected_reasons", "closed_reasons", "assign_attempts"} {
+		if _, ok := got[key]; !ok {
+			t.Errorf("missing key %q in %s", key, b)
+		}
+	}
+	if len(got) != 5 {
+		t.Errorf("got %d keys, want 5: %s", len(got), b)
+	}
+
+	reasons, _ := got["rejected_reasons"].(map[string]interface{})
+	for _, r := range rejectedReasons {
+		if _, ok := reasons[r]; !ok {
+			t.Errorf("missing rejected reason %q in %s", r, b)
+		}
+	}
+}
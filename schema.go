@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+)
+
+// csvColumnTypes maps Go field kinds to the type names used in the schema comment.
+var csvColumnTypes = map[reflect.Kind]string{
+	reflect.String:  "string",
+	reflect.Int:     "int",
+	reflect.Float64: "float",
+	reflect.Bool:    "bool",
+}
+
+// schemaComment returns a "#"-prefixed line listing column:type pairs for the
+// csv-tagged fields of row, in column order, e.g.
+// "# id:string,market:string,no_of_assign_attempts:int".
+func schemaComment(row interface{}) string {
+	t := reflect.TypeOf(row)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	columns := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("csv"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		typ, ok := csvColumnTypes[ft.Kind()]
+		if !ok {
+			typ = "string"
+		}
+
+		columns = append(columns, name+":"+typ)
+	}
+
+	return "# " + strings.Join(columns, ",")
+}
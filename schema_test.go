@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func TestSchemaComment(t *testing.T) {
+	type row struct {
+		ID      string  `csv:"id"`
+		Count   int     `csv:"count"`
+		Rate    float64 `csv:"rate"`
+		Flag    bool    `csv:"flag"`
+		Rating  *int    `csv:"rating"`
+		Skipped string  `csv:"-"`
+		Untyped []byte  `csv:"untyped"`
+	}
+
+	want := "# id:string,count:int,rate:float,flag:bool,rating:int,untyped:string"
+	if got := schemaComment(row{}); got != want {
+		t.Errorf("schemaComment = %q, want %q", got, want)
+	}
+	if got := schemaComment(&row{}); got != want {
+		t.Errorf("schemaComment of a pointer = %q, want %q", got, want)
+	}
+}
+
+func TestSchemaCommentPrecedesCSVHeader(t *testing.T) {
+	var b strings.Builder
+	stats := map[string]*sessionstats.SessionStats{"s1": {ID: "s1", Rating: intPtr(5)}}
+
+	if err := writeResults(&b, stats, outputOptions{Format: FormatCSV, SchemaComment: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(b.String(), "\n")
+	if len(lines) < 3 || !strings.HasPrefix(lines[0], "# ") {
+		t.Fatalf("output doesn't start with the schema comment:\n%s", b.String())
+	}
+
+	pairs := strings.Split(strings.TrimPrefix(lines[0], "# "), ",")
+	header := strings.Split(lines[1], ",")
+	if len(pairs) != len(header) {
+		t.Fatalf("schema comment has %d columns, the CSV header %d", len(pairs), len(header))
+	}
+	for i, pair := range pairs {
+		name, typ, _ := strings.Cut(pair, ":")
+		if name != header[i] {
+			t.Errorf("column %d is %q in the comment, %q in the header", i, name, header[i])
+		}
+		if name == "rating" && typ != "int" {
+			t.Errorf("rating, a *int, is typed %q, want int", typ)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package sessionstats
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const checkpointInterval = 30 * time.Second
+
+// checkpointParams identifies the scan a checkpoint belongs to. Resuming with
+// different parameters would mix two scans into one result, so they have to
+// match exactly.
+type checkpointParams struct {
+	Table         string `json:"table"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	TimeSource    string `json:"time_source"`
+	KeyRangeStart string `json:"key_range_start"`
+	KeyRangeEnd   string `json:"key_range_end"`
+	Segments      int    `json:"segments"`
+	// Mappings is a hash of the event mappings the stats were folded with.
+	Mappings string `json:"mappings"`
+}
+
+func newCheckpointParams(opts Options) checkpointParams {
+	return checkpointParams{
+		Table:         opts.Table,
+		From:          opts.From.UTC().Format(time.RFC3339),
+		To:            opts.To.UTC().Format(time.RFC3339),
+		TimeSource:    opts.TimeSource,
+		KeyRangeStart: opts.KeyRangeStart,
+		KeyRangeEnd:   opts.KeyRangeEnd,
+		Segments:      opts.Segments,
+		Mappings:      mappingsHash(opts.Mappings),
+	}
+}
+
+// mappingsHash identifies a mapping table by the SHA-256 of its JSON encoding.
+func mappingsHash(mappings []EventMapping) string {
+	b, _ := json.Marshal(mappings)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointConfig tells collectStats where to save checkpoints and, with
+// Resume, which saved state to continue from.
+type checkpointConfig struct {
+	Path   string
+	Params checkpointParams
+	Resume *checkpoint
+}
+
+// checkpoint is the state of a scan as saved to Options.CheckpointFile: where
+// each segment stopped and everything folded in up to there. Sessions span
+// pages, so the partially built stats are saved along with the keys.
+type checkpoint struct {
+	Params           checkpointParams          `json:"params"`
+	Segments         map[int]checkpointSegment `json:"segments"`
+	Pages            int                       `json:"pages"`
+	Items            int                       `json:"items"`
+	OffsetTimestamps int                       `json:"offset_timestamps"`
+	ItemErrors       []string                  `json:"item_errors,omitempty"`
+	UnknownMetadata  map[string]int            `json:"unknown_metadata,omitempty"`
+	Stats            map[string]*SessionStats  `json:"stats"`
+	// AssignAttempts holds the unexported SessionStats.assignAttempts by
+	// session id, so a replay read after resuming isn't counted again.
+	AssignAttempts map[string]map[string]string `json:"assign_attempts,omitempty"`
+}
+
+// checkpointSegment is a segmentCursor with the key in DynamoDB JSON, the
+// encoding table exports use.
+type checkpointSegment struct {
+	LastEvaluatedKey map[string]json.RawMessage `json:"last_evaluated_key,omitempty"`
+	Done             bool                       `json:"done,omitempty"`
+}
+
+// readCheckpoint loads a checkpoint saved by saveCheckpoint. A missing file
+// is reported as an fs.ErrNotExist error.
+func readCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return &cp, nil
+}
+
+// saveCheckpoint writes the current state of c to cfg.Path. The file is
+// written next to it and renamed into place, so a crash mid-write leaves the
+// previous checkpoint intact.
+func saveCheckpoint(cfg *checkpointConfig, c *collector) error {
+	b, err := c.marshalCheckpoint(cfg.Params)
+	if err != nil {
+		return err
+	}
+
+	tmp := cfg.Path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, cfg.Path)
+}
+
+// saveCheckpoints saves a checkpoint of c every interval until ctx is done.
+// A failed save is logged and retried at the next tick; the scan
+// itself goes on.
+func saveCheckpoints(ctx context.Context, cfg *checkpointConfig, c *collector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := saveCheckpoint(cfg, c); err != nil {
+				slog.Warn("saving checkpoint failed", "path", cfg.Path, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// marshalCheckpoint encodes the state of c. The stats keep changing while the
+// scan runs, so they are copied under c.mu and encoded after releasing it:
+// the copy is cheap next to the encoding, which on a long scan with many
+// sessions would otherwise stall every segment.
+func (c *collector) marshalCheckpoint(params checkpointParams) ([]byte, error) {
+	cp, cursors := c.snapshot(params)
+
+	for segment, cursor := range cursors {
+		key, err := encodeDynamoJSONMap(cursor.LastEvaluatedKey)
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %w", segment, err)
+		}
+		cp.Segments[segment] = checkpointSegment{LastEvaluatedKey: key, Done: cursor.Done}
+	}
+
+	return json.Marshal(cp)
+}
+
+// snapshot copies the state of c into a checkpoint, leaving out the segment
+// keys, which are returned as cursors to be encoded by the caller. Nothing in
+// the result is shared with c except values the scan replaces rather than
+// modifies.
+func (c *collector) snapshot(params checkpointParams) (*checkpoint, map[int]segmentCursor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := &checkpoint{
+		Params:           params,
+		Segments:         make(map[int]checkpointSegment, len(c.cursors)),
+		Pages:            c.pages,
+		Items:            c.items,
+		OffsetTimestamps: c.offsetTimestamps,
+		UnknownMetadata:  make(map[string]int, len(c.unknownMetadata)),
+		Stats:            make(map[string]*SessionStats, len(c.stats)),
+		AssignAttempts:   make(map[string]map[string]string),
+	}
+	for prefix, n := range c.unknownMetadata {
+		cp.UnknownMetadata[prefix] = n
+	}
+	for _, err := range c.itemErrors {
+		cp.ItemErrors = append(cp.ItemErrors, err.Error())
+	}
+	for id, s := range c.stats {
+		stats := *s
+		cp.Stats[id] = &stats
+		if len(s.assignAttempts) > 0 {
+			attempts := make(map[string]string, len(s.assignAttempts))
+			for attempt, at := range s.assignAttempts {
+				attempts[attempt] = at
+			}
+			cp.AssignAttempts[id] = attempts
+		}
+	}
+
+	cursors := make(map[int]segmentCursor, len(c.cursors))
+	for segment, cursor := range c.cursors {
+		cursors[segment] = cursor
+	}
+
+	return cp, cursors
+}
+
+// restore replaces the state of the fresh collector c with cp.
+func (c *collector) restore(cp *checkpoint) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for segment, s := range cp.Segments {
+		key, err := decodeDynamoJSONMap(s.LastEvaluatedKey)
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", segment, err)
+		}
+		if len(key) == 0 {
+			key = nil
+		}
+		c.cursors[segment] = segmentCursor{LastEvaluatedKey: key, Done: s.Done}
+	}
+
+	c.pages = cp.Pages
+	c.items = cp.Items
+	c.offsetTimestamps = cp.OffsetTimestamps
+	for _, msg := range cp.ItemErrors {
+		c.itemErrors = append(c.itemErrors, errors.New(msg))
+	}
+	for prefix, n := range cp.UnknownMetadata {
+		c.unknownMetadata[prefix] = n
+	}
+	for id, s := range cp.Stats {
+		s.assignAttempts = cp.AssignAttempts[id]
+		c.stats[id] = s
+	}
+
+	return nil
+}
+
+// encodeDynamoJSONMap is the inverse of decodeDynamoJSONMap for key
+// attributes, which can only be strings, numbers or binary.
+func encodeDynamoJSONMap(item map[string]types.AttributeValue) (map[string]json.RawMessage, error) {
+	if item == nil {
+		return nil, nil
+	}
+
+	m := make(map[string]json.RawMessage, len(item))
+	for name, av := range item {
+		var (
+			raw []byte
+			err error
+		)
+		switch v := av.(type) {
+		case *types.AttributeValueMemberS:
+			raw, err = json.Marshal(map[string]string{"S": v.Value})
+		case *types.AttributeValueMemberN:
+			raw, err = json.Marshal(map[string]string{"N": v.Value})
+		case *types.AttributeValueMemberB:
+			raw, err = json.Marshal(map[string][]byte{"B": v.Value})
+		default:
+			err = fmt.Errorf("unsupported key attribute type %T", av)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		m[name] = raw
+	}
+
+	return m, nil
+}
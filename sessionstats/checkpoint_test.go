@@ -0,0 +1,95 @@
+package sessionstats
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func TestCollectStatsResumesFromCheckpoint(t *testing.T) {
+	pages := [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+			eventItem("s1", TutorAssignedToSessionEvent+"#b", "2022-03-01T10:00:05Z", "2022-03-01T10:00:05Z"),
+		},
+		{
+			rawItem("s1", TutorAssignedToSessionEvent+"#c", "2022-03-01T10:00:30Z"),
+			// A replay of #b, which was counted before the checkpoint.
+			eventItem("s1", TutorAssignedToSessionEvent+"#e", "2022-03-01T10:00:05Z", "2022-03-01T12:00:00Z"),
+			rawItem("s2", SessionCreatedByTutorEvent+"#d", "2022-03-01T11:00:00Z"),
+		},
+	}
+	cfg := &checkpointConfig{
+		Path:   filepath.Join(t.TempDir(), "scan.checkpoint"),
+		Params: checkpointParams{Table: "sessions", Segments: 1},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := &cancellingScanner{cancel: cancel, fakeScanner: fakeScanner{pages: pages}}
+	if _, err := collectStats(ctx, interrupted, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), cfg); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+
+	cp, err := readCheckpoint(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Params != cfg.Params || cp.Items != 2 || len(cp.Stats) != 1 {
+		t.Fatalf("checkpoint = %+v, want the first page of the scan", cp)
+	}
+
+	cfg.Resume = cp
+	c, err := collectStats(context.Background(), &fakeScanner{pages: pages}, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.items != 5 {
+		t.Errorf("got %d items after resuming, want 5 (the first page must not be read twice)", c.items)
+	}
+	if len(c.stats) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(c.stats))
+	}
+	if got := c.stats["s1"].NoOfAssignAttempts; got != 2 {
+		t.Errorf("s1 assign attempts = %d, want 2 across the resumed pages, the replay not counted", got)
+	}
+
+	cp, err = readCheckpoint(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.Segments[0].Done {
+		t.Errorf("final checkpoint doesn't mark the segment done: %+v", cp.Segments)
+	}
+}
+
+func TestCollectRefusesCheckpointOfOtherMappings(t *testing.T) {
+	pages := [][]map[string]types.AttributeValue{
+		{rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z")},
+	}
+	opts := Options{
+		Table:          "sessions",
+		From:           time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:             time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		CheckpointFile: filepath.Join(t.TempDir(), "scan.checkpoint"),
+	}
+	if _, err := Collect(context.Background(), &fakeScanner{pages: pages}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Resume = true
+	if _, err := Collect(context.Background(), &fakeScanner{pages: pages}, opts); err != nil {
+		t.Fatalf("resuming with the same mappings failed: %v", err)
+	}
+
+	opts.Mappings = []EventMapping{{Prefix: SessionCreatedByUserEvent, Action: "created", Value: "TUTOR"}}
+	if _, err := Collect(context.Background(), &fakeScanner{pages: pages}, opts); err == nil {
+		t.Error("resumed a checkpoint saved with other event mappings")
+	}
+}
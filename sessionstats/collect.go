@@ -0,0 +1,197 @@
+package sessionstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// Options configures a collection. Only Table (for Collect), From and To are
+// required, with From before To.
+type Options struct {
+	Table string
+	// From and To bound the scan window, both exclusive.
+	From time.Time
+	To   time.Time
+	// TimeSource selects the timestamp used for the window and the time
+	// columns, TimeSourceIngestion by default.
+	TimeSource string
+	// KeyRangeStart and KeyRangeEnd restrict the scan to session ids in
+	// [KeyRangeStart, KeyRangeEnd); an empty bound is open.
+	KeyRangeStart string
+	KeyRangeEnd   string
+	// Market, when set, keeps only the sessions of that market. It is
+	// applied after the read: only the SESSION item carries the market, so
+	// a session's domain events can't be filtered on it server-side.
+	Market string
+	// Segments is the number of parallel scan segments, 1 by default.
+	Segments int
+	// Mappings replaces the production event catalog, see LoadEventMappings.
+	Mappings []EventMapping
+	// CountOnly reads the same items but only counts them and their
+	// distinct sessions instead of building per-session stats.
+	CountOnly bool
+	// Progress, when set, receives a progress line every few seconds.
+	Progress io.Writer
+	// CheckpointFile, when set, is where the scan state is saved every 30s
+	// and when the scan stops. With Resume a scan saved there for the same
+	// options is continued instead of starting over.
+	CheckpointFile string
+	Resume         bool
+}
+
+func (opts Options) withDefaults() Options {
+	if opts.TimeSource == "" {
+		opts.TimeSource = TimeSourceIngestion
+	}
+	if opts.Segments == 0 {
+		opts.Segments = 1
+	}
+	if opts.Mappings == nil {
+		opts.Mappings = defaultEventMappings
+	}
+
+	return opts
+}
+
+func (opts Options) validate() error {
+	if opts.From.IsZero() || opts.To.IsZero() {
+		return errors.New("the window needs both From and To")
+	}
+	if !opts.From.Before(opts.To) {
+		return fmt.Errorf("invalid window: from %s must be before to %s", opts.From.Format(time.RFC3339), opts.To.Format(time.RFC3339))
+	}
+	if _, ok := timeAttributes[opts.TimeSource]; !ok {
+		return fmt.Errorf("invalid time source %q: must be %q or %q", opts.TimeSource, TimeSourceEvent, TimeSourceIngestion)
+	}
+	if opts.Segments < 1 {
+		return fmt.Errorf("invalid segment count %d: must be at least 1", opts.Segments)
+	}
+	if opts.CountOnly && opts.Market != "" {
+		return errors.New("the market filter needs the full session stats and can't be combined with CountOnly")
+	}
+
+	return nil
+}
+
+// Result is what a collection gathered: the sessions and the diagnostics
+// about the items read on the way.
+type Result struct {
+	// Stats holds the finished row of every session, keyed by id. It is
+	// empty with Options.CountOnly.
+	Stats map[string]*SessionStats
+	// Pages and Items count what was read; Sessions the distinct session ids
+	// among the items, also with Options.CountOnly.
+	Pages    int
+	Items    int
+	Sessions int
+	// ItemErrors describe the items that were skipped as malformed.
+	ItemErrors []error
+	// UnknownMetadata counts the skipped items per unknown event type.
+	UnknownMetadata map[string]int
+	// OffsetTimestamps counts the items whose timestamp has a non-Z offset,
+	// which the string comparisons of the window filter get wrong.
+	OffsetTimestamps int
+	// TimestampErrors describe the timestamps that didn't parse and were
+	// cleared from Stats.
+	TimestampErrors []error
+}
+
+// CollectStats scans the table with scanner and returns the stats of every
+// session with events in the window. When the scan fails, or ctx is done
+// before it finishes, the sessions collected so far are returned along with
+// the error.
+func CollectStats(ctx context.Context, scanner Scanner, opts Options) (map[string]*SessionStats, error) {
+	res, err := Collect(ctx, scanner, opts)
+	if res == nil {
+		return nil, err
+	}
+
+	return res.Stats, err
+}
+
+// Collect is CollectStats returning the diagnostics as well. The Result is
+// nil only when the scan couldn't start.
+func Collect(ctx context.Context, scanner Scanner, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	if opts.Table == "" {
+		return nil, errors.New("no table given")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	var checkpoints *checkpointConfig
+	if opts.CheckpointFile != "" {
+		checkpoints = &checkpointConfig{Path: opts.CheckpointFile, Params: newCheckpointParams(opts)}
+	}
+	if checkpoints != nil && opts.Resume {
+		cp, err := readCheckpoint(opts.CheckpointFile)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			slog.Info("no checkpoint to resume, starting a fresh scan", "path", opts.CheckpointFile)
+		case err != nil:
+			return nil, fmt.Errorf("invalid checkpoint: %w", err)
+		case cp.Params != checkpoints.Params:
+			return nil, fmt.Errorf("checkpoint %s was saved for a different scan (%+v), not resuming it", opts.CheckpointFile, cp.Params)
+		default:
+			checkpoints.Resume = cp
+		}
+	}
+
+	c, err := collectStats(ctx, scanner, newScanInput(opts), opts, checkpoints)
+
+	return c.result(opts.Market), err
+}
+
+// CollectFromExport is Collect reading a DynamoDB table export instead of
+// scanning the table: every DYNAMODB_JSON data file under bucket/prefix, with
+// the conditions the scan would have applied. opts.Table, Segments and the
+// checkpoint options don't apply.
+func CollectFromExport(ctx context.Context, client S3ExportAPI, bucket, prefix string, opts Options) (*Result, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	c, err := collectFromExport(ctx, client, bucket, prefix, opts)
+
+	return c.result(opts.Market), err
+}
+
+// result finishes the sessions of a collector that is done scanning, keeping
+// only those of market when it is set, and returns them with its diagnostics.
+func (c *collector) result(market string) *Result {
+	if market != "" {
+		filterByMarket(c.stats, market)
+	}
+
+	res := &Result{
+		Stats:            c.stats,
+		Pages:            c.pages,
+		Items:            c.items,
+		Sessions:         c.sessionCount(),
+		ItemErrors:       c.itemErrors,
+		UnknownMetadata:  c.unknownMetadata,
+		OffsetTimestamps: c.offsetTimestamps,
+	}
+
+	for _, s := range res.Stats {
+		res.TimestampErrors = append(res.TimestampErrors, Finalize(s)...)
+	}
+
+	return res
+}
+
+// filterByMarket drops the sessions whose resolved Market isn't market.
+func filterByMarket(statsMap map[string]*SessionStats, market string) {
+	for id, s := range statsMap {
+		if s.Market != market {
+			delete(statsMap, id)
+		}
+	}
+}
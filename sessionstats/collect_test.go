@@ -0,0 +1,47 @@
+package sessionstats
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCollectRejectsInvalidOptions(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{name: "no table", opts: Options{From: from, To: to}},
+		{name: "no window", opts: Options{Table: "sessions"}},
+		{name: "no from", opts: Options{Table: "sessions", To: to}},
+		{name: "reversed window", opts: Options{Table: "sessions", From: to, To: from}},
+		{name: "empty window", opts: Options{Table: "sessions", From: from, To: from}},
+		{name: "unknown time source", opts: Options{Table: "sessions", From: from, To: to, TimeSource: "wall"}},
+		{name: "negative segments", opts: Options{Table: "sessions", From: from, To: to, Segments: -1}},
+		{name: "market with count only", opts: Options{Table: "sessions", From: from, To: to, Market: "pl", CountOnly: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Collect(context.Background(), &fakeScanner{}, tt.opts)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if res != nil {
+				t.Errorf("got a result %+v for options that can't start a scan", res)
+			}
+		})
+	}
+}
+
+func TestCollectFromExportRejectsReversedWindow(t *testing.T) {
+	from := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	if _, err := CollectFromExport(context.Background(), &fakeExport{}, "bucket", "export/", Options{From: to, To: from}); err == nil {
+		t.Error("expected an error for a reversed window")
+	}
+}
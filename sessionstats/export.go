@@ -0,0 +1,279 @@
+package sessionstats
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// exportPageSize is how many export lines are folded into the collector at
+// once, mirroring a Scan page.
+const exportPageSize = 1000
+
+// maxExportLine bounds a single item line in an export file.
+const maxExportLine = 16 * 1024 * 1024
+
+// S3ExportAPI is the part of the S3 client needed to read an export.
+type S3ExportAPI interface {
+	s3.ListObjectsV2APIClient
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// collectFromExport folds every item of the export data files under
+// bucket/prefix into per-session stats, applying the same window, metadata
+// and key range conditions the scan would have sent as its FilterExpression.
+// Like collectStats it returns the partial collector along with an error; lines
+// that don't decode are recorded as item errors and skipped.
+func collectFromExport(ctx context.Context, client S3ExportAPI, bucket, prefix string, opts Options) (*collector, error) {
+	c := newCollector(opts)
+
+	if opts.Progress != nil {
+		progressCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		go reportProgress(progressCtx, opts.Progress, c, progressInterval)
+	}
+
+	p := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	file := 0
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return c, err
+		}
+
+		for _, obj := range out.Contents {
+			key := aws.ToString(obj.Key)
+			if !strings.HasSuffix(key, ".json.gz") {
+				continue
+			}
+
+			if err := readExportFile(ctx, client, bucket, key, file, opts, c); err != nil {
+				return c, fmt.Errorf("s3://%s/%s: %w", bucket, key, err)
+			}
+			file++
+		}
+	}
+
+	return c, nil
+}
+
+func readExportFile(ctx context.Context, client S3ExportAPI, bucket, key string, file int, opts Options, c *collector) error {
+	obj, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	gz, err := gzip.NewReader(obj.Body)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxExportLine)
+
+	page := make([]map[string]types.AttributeValue, 0, exportPageSize)
+	pageNo := 1
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		item, err := decodeExportLine(scanner.Bytes())
+		if err != nil {
+			c.addItemError(fmt.Errorf("s3://%s/%s line %d: %w", bucket, key, line, err))
+			continue
+		}
+
+		if !exportItemMatches(item, opts) {
+			continue
+		}
+
+		page = append(page, item)
+		if len(page) == exportPageSize {
+			c.addPage(file, pageNo, page)
+			page = make([]map[string]types.AttributeValue, 0, exportPageSize)
+			pageNo++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(page) > 0 {
+		c.addPage(file, pageNo, page)
+	}
+
+	return nil
+}
+
+// decodeExportLine decodes one line of a DYNAMODB_JSON export, which wraps the
+// item in {"Item": {...}}, into the attribute values Scan would have returned,
+// so the items go through the same attributevalue unmarshalling.
+func decodeExportLine(line []byte) (map[string]types.AttributeValue, error) {
+	var wrapper struct {
+		Item map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(line, &wrapper); err != nil {
+		return nil, err
+	}
+	if wrapper.Item == nil {
+		return nil, fmt.Errorf("missing Item")
+	}
+
+	return decodeDynamoJSONMap(wrapper.Item)
+}
+
+func decodeDynamoJSONMap(m map[string]json.RawMessage) (map[string]types.AttributeValue, error) {
+	item := make(map[string]types.AttributeValue, len(m))
+	for name, raw := range m {
+		av, err := decodeDynamoJSON(raw)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		item[name] = av
+	}
+
+	return item, nil
+}
+
+// decodeDynamoJSON decodes a single DynamoDB JSON value such as {"S": "abc"}.
+func decodeDynamoJSON(raw json.RawMessage) (types.AttributeValue, error) {
+	var typed map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &typed); err != nil {
+		return nil, err
+	}
+	if len(typed) != 1 {
+		return nil, fmt.Errorf("expected exactly one type key, got %d", len(typed))
+	}
+
+	var (
+		typ   string
+		value json.RawMessage
+	)
+	for typ, value = range typed {
+		// typed holds exactly one entry.
+	}
+
+	switch typ {
+	case "S":
+		var v string
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberS{Value: v}, err
+	case "N":
+		var v string
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberN{Value: v}, err
+	case "B":
+		var v []byte
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberB{Value: v}, err
+	case "BOOL":
+		var v bool
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberBOOL{Value: v}, err
+	case "NULL":
+		var v bool
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberNULL{Value: v}, err
+	case "SS":
+		var v []string
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberSS{Value: v}, err
+	case "NS":
+		var v []string
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberNS{Value: v}, err
+	case "BS":
+		var v [][]byte
+		err := json.Unmarshal(value, &v)
+		return &types.AttributeValueMemberBS{Value: v}, err
+	case "M":
+		var v map[string]json.RawMessage
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, err
+		}
+		m, err := decodeDynamoJSONMap(v)
+		return &types.AttributeValueMemberM{Value: m}, err
+	case "L":
+		var v []json.RawMessage
+		if err := json.Unmarshal(value, &v); err != nil {
+			return nil, err
+		}
+		l := make([]types.AttributeValue, len(v))
+		for i, raw := range v {
+			av, err := decodeDynamoJSON(raw)
+			if err != nil {
+				return nil, fmt.Errorf("index %d: %w", i, err)
+			}
+			l[i] = av
+		}
+		return &types.AttributeValueMemberL{Value: l}, nil
+	default:
+		return nil, fmt.Errorf("unknown type %q", typ)
+	}
+}
+
+func stringAttr(item map[string]types.AttributeValue, name string) (string, bool) {
+	v, ok := item[name].(*types.AttributeValueMemberS)
+	if !ok {
+		return "", false
+	}
+
+	return v.Value, true
+}
+
+// exportItemMatches applies the conditions newScanInput puts in the scan's
+// FilterExpression, with the same string comparisons, to an exported item.
+func exportItemMatches(item map[string]types.AttributeValue, opts Options) bool {
+	from := opts.From.UTC().Format(time.RFC3339)
+	to := opts.To.UTC().Format(time.RFC3339)
+
+	at, ok := stringAttr(item, "createdAt")
+	if opts.TimeSource == TimeSourceEvent {
+		if eventTime, hasEventTime := stringAttr(item, "eventTime"); hasEventTime {
+			at, ok = eventTime, true
+		} else if _, exists := item["eventTime"]; exists {
+			ok = false
+		}
+	}
+	if !ok || at <= from || at >= to {
+		return false
+	}
+
+	metadata, _ := stringAttr(item, "metadata")
+	if metadata != SessionMetadata && !strings.HasPrefix(metadata, "DOMAINEVENT#") {
+		return false
+	}
+
+	if opts.KeyRangeStart != "" || opts.KeyRangeEnd != "" {
+		id, ok := stringAttr(item, "id")
+		if !ok {
+			return false
+		}
+		if opts.KeyRangeStart != "" && id < opts.KeyRangeStart {
+			return false
+		}
+		if opts.KeyRangeEnd != "" && id >= opts.KeyRangeEnd {
+			return false
+		}
+	}
+
+	return true
+}
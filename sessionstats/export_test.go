@@ -0,0 +1,173 @@
+package sessionstats
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeExport serves gzipped export files from memory.
+type fakeExport struct {
+	files map[string]string
+}
+
+func (f *fakeExport) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	out := &s3.ListObjectsV2Output{}
+	for key := range f.files {
+		out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	out.Contents = append(out.Contents, s3types.Object{Key: aws.String("export/manifest-summary.json")})
+
+	return out, nil
+}
+
+func (f *fakeExport) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	gz.Write([]byte(f.files[aws.ToString(params.Key)]))
+	gz.Close()
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(&b)}, nil
+}
+
+func TestCollectFromExport(t *testing.T) {
+	client := &fakeExport{files: map[string]string{
+		"export/data/a.json.gz": `{"Item":{"id":{"S":"s1"},"metadata":{"S":"SESSION"},"createdAt":{"S":"2022-03-01T10:00:00Z"},"market":{"S":"pl"}}}
+{"Item":{"id":{"S":"s1"},"metadata":{"S":"DOMAINEVENT#SessionCreatedByUser#a"},"createdAt":{"S":"2022-03-01T10:00:00Z"}}}
+{"Item":{"id":{"S":"s1"},"metadata":{"S":"DOMAINEVENT#SessionCreatedByTutor#x"},"createdAt":{"Q":"2022-03-01T10:00:00Z"}}}
+{"Item":{"id":{"S":"s1"},"metadata":{"S":"DOMAINEVENT#SessionRatedByUser#b"},"createdAt":{"S":"2022-03-01T10:20:00Z"},"rating":{"N":"5"}}}
+{"Item":{"id":{"S":"s2"},"metadata":{"S":"DOMAINEVENT#SessionCreatedByUser#c"},"createdAt":{"S":"2022-05-01T10:00:00Z"}}}
+{"Item":{"id":{"S":"s3"},"metadata":{"S":"TUTOR#x"},"createdAt":{"S":"2022-03-01T10:00:00Z"}}}
+`,
+	}}
+	opts := Options{
+		From:       time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:         time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		TimeSource: TimeSourceIngestion,
+	}
+
+	c, err := collectFromExport(context.Background(), client, "bucket", "export/", opts.withDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(c.stats) != 1 {
+		t.Fatalf("got %d sessions, want only s1 (s2 is outside the window, s3 isn't a session event): %v", len(c.stats), c.stats)
+	}
+
+	if len(c.itemErrors) != 1 || !strings.Contains(c.itemErrors[0].Error(), "s3://bucket/export/data/a.json.gz line 3") {
+		t.Errorf("got item errors %v, want one for line 3 of a.json.gz", c.itemErrors)
+	}
+
+	s1 := c.stats["s1"]
+	if s1.Market != "pl" || s1.CreatedByRole != "USER" || s1.Rating == nil || *s1.Rating != 5 {
+		t.Errorf("unexpected s1 stats: %+v", s1)
+	}
+}
+
+func TestDecodeDynamoJSON(t *testing.T) {
+	item, err := decodeExportLine([]byte(`{"Item":{"m":{"M":{"l":{"L":[{"N":"1"},{"BOOL":true},{"NULL":true}]}}},"ss":{"SS":["a","b"]}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := item["m"].(*types.AttributeValueMemberM)
+	if !ok {
+		t.Fatalf("m decoded as %T", item["m"])
+	}
+	l, ok := m.Value["l"].(*types.AttributeValueMemberL)
+	if !ok || len(l.Value) != 3 {
+		t.Fatalf("l decoded as %#v", m.Value["l"])
+	}
+	if n, ok := l.Value[0].(*types.AttributeValueMemberN); !ok || n.Value != "1" {
+		t.Errorf("l[0] decoded as %#v", l.Value[0])
+	}
+	if ss, ok := item["ss"].(*types.AttributeValueMemberSS); !ok || len(ss.Value) != 2 {
+		t.Errorf("ss decoded as %#v", item["ss"])
+	}
+
+	if _, err := decodeExportLine([]byte(`{"Item":{"x":{"Q":"1"}}}`)); err == nil {
+		t.Error("expected an error for an unknown type")
+	}
+}
+
+func TestExportItemMatches(t *testing.T) {
+	opts := Options{
+		From:          time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:            time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		TimeSource:    TimeSourceIngestion,
+		KeyRangeStart: "s1",
+		KeyRangeEnd:   "s5",
+	}
+	eventTimeOpts := opts
+	eventTimeOpts.TimeSource = TimeSourceEvent
+
+	tests := []struct {
+		name string
+		item map[string]types.AttributeValue
+		opts Options
+		want bool
+	}{
+		{name: "inside the window and range", item: rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"), opts: opts, want: true},
+		{name: "session item", item: rawItem("s2", SessionMetadata, "2022-03-01T10:00:00Z"), opts: opts, want: true},
+		{name: "range end is exclusive", item: rawItem("s5", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"), opts: opts},
+		{name: "before the range", item: rawItem("s0", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"), opts: opts},
+		{name: "outside the window", item: rawItem("s2", SessionCreatedByUserEvent+"#a", "2022-04-01T10:00:00Z"), opts: opts},
+		{name: "not a session event", item: rawItem("s2", "TUTOR#x", "2022-03-01T10:00:00Z"), opts: opts},
+		{
+			name: "event time inside the window, ingested after it",
+			item: eventItem("s2", SessionCreatedByUserEvent+"#a", "2022-03-31T23:59:00Z", "2022-04-01T00:01:00Z"),
+			opts: eventTimeOpts,
+			want: true,
+		},
+		{
+			name: "event time falls back to createdAt",
+			item: rawItem("s2", SessionMetadata, "2022-03-01T10:00:00Z"),
+			opts: eventTimeOpts,
+			want: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exportItemMatches(tt.item, tt.opts); got != tt.want {
+				t.Errorf("exportItemMatches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportItemMatchesPrefixShard(t *testing.T) {
+	// The shard of ids starting with 8 through f, as the --key-range-end help
+	// describes it.
+	opts := Options{
+		From:          time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+		To:            time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+		TimeSource:    TimeSourceIngestion,
+		KeyRangeStart: "8",
+		KeyRangeEnd:   "g",
+	}
+
+	for id, want := range map[string]bool{
+		"7fffffff": false,
+		"8":        true,
+		"80000000": true,
+		"ffffffff": true,
+		"f":        true,
+		"g":        false,
+		"g0000000": false,
+	} {
+		if got := exportItemMatches(rawItem(id, SessionMetadata, "2022-03-01T10:00:00Z"), opts); got != want {
+			t.Errorf("id %q: matches = %v, want %v", id, got, want)
+		}
+	}
+}
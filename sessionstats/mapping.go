@@ -0,0 +1,122 @@
+package sessionstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// EventMapping maps the items whose metadata starts with Prefix to one of the
+// actions listed at LoadEventMappings. Value parameterises the action: the
+// creator role of "created" and the reason of "rejected" and "closed".
+type EventMapping struct {
+	Prefix string `json:"prefix"`
+	Action string `json:"action"`
+	Value  string `json:"value,omitempty"`
+}
+
+// eventAction folds one item into stats; at is its timestamp for the chosen
+// time source.
+type eventAction func(stats *SessionStats, item DynamoItem, at, value string)
+
+// eventActions are the fields a mapping can feed, keyed by the action name
+// used in --mapping-file.
+var eventActions = map[string]eventAction{
+	"market": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.Market = item.Market
+	},
+	"created": func(stats *SessionStats, item DynamoItem, at, value string) {
+		setCreation(stats, at, value)
+	},
+	"confirmed": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.ConfirmedAt = at
+	},
+	"rejected": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.RejectedAt = at
+		stats.RejectedReason = value
+	},
+	"closed": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.ClosedAt = at
+		stats.ClosedReason = value
+	},
+	"assigned": func(stats *SessionStats, item DynamoItem, at, value string) {
+		addAssignAttempt(stats, item, at)
+	},
+	"rated": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.Rating = item.Rating
+	},
+	"question_updated": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.NoOfQuestionUpdates += 1
+	},
+	"unassigned_on_confirmation_timeout": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.UnassignedOnConfirmationTimeout += 1
+	},
+	"unassigned_on_tutor_disconnected": func(stats *SessionStats, item DynamoItem, at, value string) {
+		stats.UnassignedOnTutorDisconnected += 1
+	},
+	// ignore accepts a known event type that doesn't feed any column, so it
+	// isn't reported as unknown metadata.
+	"ignore": func(stats *SessionStats, item DynamoItem, at, value string) {},
+}
+
+// valueActions are the actions that need a Value.
+var valueActions = map[string]bool{
+	"created":  true,
+	"rejected": true,
+	"closed":   true,
+}
+
+// defaultEventMappings is the event catalog of the production table. Like any
+// mappings, it is consulted in order and the first matching prefix wins.
+var defaultEventMappings = []EventMapping{
+	{Prefix: SessionMetadata, Action: "market"},
+	{Prefix: SessionCreatedByUserEvent, Action: "created", Value: "USER"},
+	{Prefix: SessionCreatedByTutorEvent, Action: "created", Value: "TUTOR"},
+	{Prefix: SessionConfirmedByTutorEvent, Action: "confirmed"},
+	{Prefix: SessionRejectedByUserEvent, Action: "rejected", Value: "user"},
+	{Prefix: SessionRejectedOnMatchingTimeoutEvent, Action: "rejected", Value: "matching_timeout"},
+	{Prefix: SessionRejectedOnNoTutorsEvent, Action: "rejected", Value: "no_tutors"},
+	{Prefix: SessionClosedByTutorEvent, Action: "closed", Value: "tutor"},
+	{Prefix: SessionClosedByUserEvent, Action: "closed", Value: "user"},
+	{Prefix: SessionClosedOnTutorDisconnectedEvent, Action: "closed", Value: "tutor_disconnected"},
+	{Prefix: TutorAssignedToSessionEvent, Action: "assigned"},
+	{Prefix: SessionRatedByUserEvent, Action: "rated"},
+	{Prefix: SessionReportedByTutorEvent, Action: "ignore"},
+	{Prefix: QuestionUpdatedEvent, Action: "question_updated"},
+	{Prefix: TutorUnassignedFromSessionOnConfirmationTimeoutEvent, Action: "unassigned_on_confirmation_timeout"},
+	{Prefix: TutorUnassignedFromSessionOnTutorDisconnectedEvent, Action: "unassigned_on_tutor_disconnected"},
+}
+
+// LoadEventMappings reads a JSON array of mappings such as
+//
+//	[{"prefix": "DOMAINEVENT#SessionCreatedByUser", "action": "created", "value": "USER"}]
+//
+// from path, for Options.Mappings, and checks every action exists. The
+// actions are market, created, confirmed, rejected, closed, assigned, rated,
+// question_updated, unassigned_on_confirmation_timeout,
+// unassigned_on_tutor_disconnected and ignore.
+func LoadEventMappings(path string) ([]EventMapping, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mappings []EventMapping
+	if err := json.Unmarshal(b, &mappings); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for i, m := range mappings {
+		if m.Prefix == "" {
+			return nil, fmt.Errorf("%s: mapping %d: empty prefix", path, i)
+		}
+		if _, ok := eventActions[m.Action]; !ok {
+			return nil, fmt.Errorf("%s: mapping %d (%s): unknown action %q", path, i, m.Prefix, m.Action)
+		}
+		if valueActions[m.Action] && m.Value == "" {
+			return nil, fmt.Errorf("%s: mapping %d (%s): action %q needs a value", path, i, m.Prefix, m.Action)
+		}
+	}
+
+	return mappings, nil
+}
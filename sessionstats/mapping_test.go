@@ -0,0 +1,52 @@
+package sessionstats
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadEventMappings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	err := os.WriteFile(path, []byte(`[
+		{"prefix": "SESSION", "action": "market"},
+		{"prefix": "EVT#Created", "action": "created", "value": "USER"},
+		{"prefix": "EVT#Rejected", "action": "rejected", "value": "no_tutors"}
+	]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mappings, err := LoadEventMappings(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var s SessionStats
+	for _, item := range []DynamoItem{
+		{Metadata: "EVT#Created#a", CreatedAt: "2022-03-01T10:00:00Z"},
+		{Metadata: "EVT#Rejected#b", CreatedAt: "2022-03-01T10:01:00Z"},
+	} {
+		if err := fillStats(&s, item, TimeSourceIngestion, mappings); err != nil {
+			t.Fatalf("%s: unexpected error: %v", item.Metadata, err)
+		}
+	}
+	if s.CreatedByRole != "USER" || s.RejectedAt != "2022-03-01T10:01:00Z" || s.RejectedReason != "no_tutors" {
+		t.Errorf("stats = %+v, want the staging events folded in", s)
+	}
+
+	if err := fillStats(&s, DynamoItem{Metadata: SessionCreatedByUserEvent + "#c"}, TimeSourceIngestion, mappings); err == nil {
+		t.Error("a default event type was accepted although the mapping file replaces the defaults")
+	}
+}
+
+func TestLoadEventMappingsRejectsUnknownAction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mapping.json")
+	if err := os.WriteFile(path, []byte(`[{"prefix": "EVT#Created", "action": "create"}]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadEventMappings(path); err == nil {
+		t.Error("want an error for an unknown action")
+	}
+}
@@ -0,0 +1,353 @@
+package sessionstats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Scanner is the part of the DynamoDB client the scan needs, so tests can
+// feed canned pages instead of talking to a table.
+type Scanner interface {
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// maxParallelSegments caps how many scan segments run at the same time;
+// further segments wait for a free slot.
+const maxParallelSegments = 16
+
+const progressInterval = 5 * time.Second
+
+// collector folds scanned pages into per-session stats. A session's events
+// may land in any page of any segment, so all segments share one collector.
+// It is safe for concurrent use.
+type collector struct {
+	timeSource string
+	mappings   []EventMapping
+	// countOnly skips the per-event bookkeeping: items are only decoded far
+	// enough to record their session id in sessions, and stats stays empty.
+	countOnly bool
+
+	mu               sync.Mutex
+	stats            map[string]*SessionStats
+	sessions         map[string]struct{}
+	pages            int
+	items            int
+	offsetTimestamps int
+	itemErrors       []error
+	unknownMetadata  map[string]int
+	// cursors holds where each scan segment stopped, for checkpoints.
+	cursors map[int]segmentCursor
+}
+
+// segmentCursor is the position of one scan segment: the LastEvaluatedKey of
+// its last folded page, or Done once it returned its final page. The zero
+// value is a segment that hasn't started.
+type segmentCursor struct {
+	LastEvaluatedKey map[string]types.AttributeValue
+	Done             bool
+}
+
+func newCollector(opts Options) *collector {
+	return &collector{
+		timeSource:      opts.TimeSource,
+		mappings:        opts.Mappings,
+		countOnly:       opts.CountOnly,
+		stats:           make(map[string]*SessionStats),
+		sessions:        make(map[string]struct{}),
+		unknownMetadata: make(map[string]int),
+		cursors:         make(map[int]segmentCursor),
+	}
+}
+
+// addPage folds one page of raw items into the stats. segment and page only
+// label the errors of items that couldn't be decoded.
+func (c *collector) addPage(segment, page int, raw []map[string]types.AttributeValue) {
+	items, errs := unmarshalItems(raw)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fold(segment, page, len(raw), items, errs)
+}
+
+// addScanPage folds a page of a scan segment like addPage and, in the same
+// critical section, moves the segment's cursor past it, so a checkpoint never
+// holds a page's items without its LastEvaluatedKey or the other way round.
+func (c *collector) addScanPage(segment, page int, out *dynamodb.ScanOutput) {
+	items, errs := unmarshalItems(out.Items)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fold(segment, page, len(out.Items), items, errs)
+	c.cursors[segment] = segmentCursor{
+		LastEvaluatedKey: out.LastEvaluatedKey,
+		Done:             len(out.LastEvaluatedKey) == 0,
+	}
+}
+
+// fold adds decoded items to the stats. The caller must hold c.mu.
+func (c *collector) fold(segment, page, raw int, items []DynamoItem, errs []error) {
+	c.pages++
+	c.items += raw
+
+	for _, err := range errs {
+		c.itemErrors = append(c.itemErrors, fmt.Errorf("segment %d page %d: %w", segment, page, err))
+	}
+
+	for _, item := range items {
+		if c.countOnly {
+			c.sessions[item.ID] = struct{}{}
+			continue
+		}
+
+		if hasNonUTCOffset(item.Time(c.timeSource)) {
+			c.offsetTimestamps++
+		}
+
+		stats, ok := c.stats[item.ID]
+		if !ok {
+			stats = &SessionStats{ID: item.ID}
+		}
+
+		// Unknown metadata is the only way the fold fails. The session is only
+		// added once one of its items folds, so events of a type nobody maps
+		// don't produce empty rows.
+		if err := fillStats(stats, item, c.timeSource, c.mappings); err != nil {
+			c.unknownMetadata[metadataPrefix(item.Metadata)]++
+			continue
+		}
+		c.stats[item.ID] = stats
+	}
+}
+
+// addItemError records an item that was read but couldn't be decoded at all,
+// so it never made it into a page.
+func (c *collector) addItemError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items++
+	c.itemErrors = append(c.itemErrors, err)
+}
+
+// progress returns the pages and items scanned and the distinct sessions
+// seen so far.
+func (c *collector) progress() (pages, items, sessions int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.pages, c.items, c.sessionCount()
+}
+
+// cursor returns where the given scan segment stopped.
+func (c *collector) cursor(segment int) segmentCursor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cursors[segment]
+}
+
+// sessionCount returns the number of distinct sessions seen. The caller must
+// hold c.mu or be done scanning.
+func (c *collector) sessionCount() int {
+	if c.countOnly {
+		return len(c.sessions)
+	}
+
+	return len(c.stats)
+}
+
+// reportProgress writes a progress line for c to w every interval until ctx
+// is done.
+func reportProgress(ctx context.Context, w io.Writer, c *collector, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pages, items, sessions := c.progress()
+			fmt.Fprintf(w, "progress: %d pages, %d items, %d sessions\n", pages, items, sessions)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// collectStats scans input with opts.Segments segments and folds every item
+// into per-session stats. A non-nil opts.Progress receives a progress line
+// every progressInterval while the scan runs. The collector is returned even
+// when the scan fails, holding whatever was folded in up to that point, along
+// with the diagnostics (malformed items, unknown metadata) gathered on the
+// way. With opts.CountOnly the collector only counts items and distinct
+// sessions.
+//
+// A non-nil checkpoints saves the scan state to its file every
+// checkpointInterval and once more when the scan ends, successfully or not;
+// if it carries a Resume state the scan continues from there instead of
+// starting over.
+func collectStats(ctx context.Context, scanner Scanner, input *dynamodb.ScanInput, opts Options, checkpoints *checkpointConfig) (*collector, error) {
+	c := newCollector(opts)
+	segments, progress := opts.Segments, opts.Progress
+	if checkpoints != nil && checkpoints.Resume != nil {
+		if err := c.restore(checkpoints.Resume); err != nil {
+			return c, fmt.Errorf("resume from %s: %w", checkpoints.Path, err)
+		}
+	}
+
+	if progress != nil {
+		progressCtx, stop := context.WithCancel(ctx)
+		defer stop()
+		go reportProgress(progressCtx, progress, c, progressInterval)
+	}
+
+	if checkpoints == nil {
+		return c, scanSegments(ctx, scanner, input, segments, c)
+	}
+
+	checkpointCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		saveCheckpoints(checkpointCtx, checkpoints, c, checkpointInterval)
+	}()
+
+	err := scanSegments(ctx, scanner, input, segments, c)
+	stop()
+	<-done
+
+	if saveErr := saveCheckpoint(checkpoints, c); saveErr != nil && err == nil {
+		err = saveErr
+	}
+
+	return c, err
+}
+
+// scanSegments runs input as a parallel scan split into the given number of
+// segments, each with its own paginator, feeding every page to c. The first
+// segment to fail cancels the others and its error is returned.
+func scanSegments(ctx context.Context, scanner Scanner, input *dynamodb.ScanInput, segments int, c *collector) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		slots    = make(chan struct{}, maxParallelSegments)
+	)
+
+	for segment := 0; segment < segments; segment++ {
+		segmentInput := *input
+		if segments > 1 {
+			segmentInput.Segment = aws.Int32(int32(segment))
+			segmentInput.TotalSegments = aws.Int32(int32(segments))
+		}
+
+		cursor := c.cursor(segment)
+		if cursor.Done {
+			continue
+		}
+		segmentInput.ExclusiveStartKey = cursor.LastEvaluatedKey
+
+		wg.Add(1)
+		go func(segment int, input *dynamodb.ScanInput) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				return
+			}
+
+			if err := scanSegment(ctx, scanner, input, segment, c); err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("segment %d: %w", segment, err)
+					cancel()
+				})
+			}
+		}(segment, &segmentInput)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+func scanSegment(ctx context.Context, scanner Scanner, input *dynamodb.ScanInput, segment int, c *collector) error {
+	p := dynamodb.NewScanPaginator(scanner, input)
+
+	for page := 1; p.HasMorePages(); page++ {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		c.addScanPage(segment, page, out)
+	}
+
+	return nil
+}
+
+// timeWindowCondition returns the filter condition restricting items to the
+// scan window for the given time source. With event time, items lacking
+// eventTime are matched on createdAt so the SESSION metadata item isn't lost.
+func timeWindowCondition(timeSource string) string {
+	if timeSource == TimeSourceEvent {
+		return "((#eventTime > :createdAtFrom AND #eventTime < :createdAtTo) OR (attribute_not_exists(#eventTime) AND #createdAt > :createdAtFrom AND #createdAt < :createdAtTo))"
+	}
+
+	return "#createdAt > :createdAtFrom AND #createdAt < :createdAtTo"
+}
+
+// newScanInput builds the Scan request for opts: the window, metadata and key
+// range conditions as a FilterExpression and the DynamoItem projection.
+func newScanInput(opts Options) *dynamodb.ScanInput {
+	filter := timeWindowCondition(opts.TimeSource) + " AND (#metadata = :sessMeta OR begins_with(#metadata, :domainEventMeta))"
+	values := map[string]types.AttributeValue{
+		":createdAtFrom":   &types.AttributeValueMemberS{Value: opts.From.UTC().Format(time.RFC3339)},
+		":createdAtTo":     &types.AttributeValueMemberS{Value: opts.To.UTC().Format(time.RFC3339)},
+		":sessMeta":        &types.AttributeValueMemberS{Value: "SESSION"},
+		":domainEventMeta": &types.AttributeValueMemberS{Value: "DOMAINEVENT#"},
+	}
+	projectionExpression, names := projection(projectedAttributes)
+	names["#createdAt"] = "createdAt"
+	names["#metadata"] = "metadata"
+
+	// DynamoDB rejects attribute names and values that the expressions don't
+	// use, so optional conditions register their own placeholders.
+	if opts.TimeSource == TimeSourceEvent {
+		names["#eventTime"] = "eventTime"
+	}
+
+	// The key range is a filter, not a key condition: every host still reads
+	// (and pays for) the whole table, it only receives its share of the items.
+	if opts.KeyRangeStart != "" {
+		filter += " AND #id >= :keyRangeStart"
+		values[":keyRangeStart"] = &types.AttributeValueMemberS{Value: opts.KeyRangeStart}
+	}
+	if opts.KeyRangeEnd != "" {
+		filter += " AND #id < :keyRangeEnd"
+		values[":keyRangeEnd"] = &types.AttributeValueMemberS{Value: opts.KeyRangeEnd}
+	}
+	if opts.KeyRangeStart != "" || opts.KeyRangeEnd != "" {
+		names["#id"] = "id"
+	}
+
+	return &dynamodb.ScanInput{
+		TableName:                 aws.String(opts.Table),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeValues: values,
+		ExpressionAttributeNames:  names,
+		ProjectionExpression:      aws.String(projectionExpression),
+	}
+}
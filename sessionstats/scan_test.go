@@ -0,0 +1,348 @@
+package sessionstats
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeScanner serves pages in order, chaining them through a fake
+// LastEvaluatedKey holding the index of the next page.
+type fakeScanner struct {
+	pages [][]map[string]types.AttributeValue
+	err   error
+}
+
+func (f *fakeScanner) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	page := 0
+	if key, ok := params.ExclusiveStartKey["page"].(*types.AttributeValueMemberN); ok {
+		page, _ = strconv.Atoi(key.Value)
+	}
+
+	out := &dynamodb.ScanOutput{Items: f.pages[page]}
+	if page+1 < len(f.pages) {
+		out.LastEvaluatedKey = map[string]types.AttributeValue{
+			"page": &types.AttributeValueMemberN{Value: strconv.Itoa(page + 1)},
+		}
+	}
+
+	return out, nil
+}
+
+func rawItem(id, metadata, createdAt string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id":        &types.AttributeValueMemberS{Value: id},
+		"metadata":  &types.AttributeValueMemberS{Value: metadata},
+		"createdAt": &types.AttributeValueMemberS{Value: createdAt},
+	}
+}
+
+func eventItem(id, metadata, eventTime, createdAt string) map[string]types.AttributeValue {
+	item := rawItem(id, metadata, createdAt)
+	item["eventTime"] = &types.AttributeValueMemberS{Value: eventTime}
+	return item
+}
+
+func TestCollectStatsAcrossPages(t *testing.T) {
+	scanner := &fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+			rawItem("s1", TutorAssignedToSessionEvent+"#b", "2022-03-01T10:00:05Z"),
+		},
+		{
+			rawItem("s1", TutorAssignedToSessionEvent+"#c", "2022-03-01T10:00:30Z"),
+			rawItem("s2", SessionRejectedOnNoTutorsEvent+"#d", "2022-03-01T11:00:00Z"),
+			rawItem("s2", "DOMAINEVENT#SomethingNew#e", "2022-03-01T11:00:01Z"),
+		},
+	}}
+
+	c, err := collectStats(context.Background(), scanner, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.stats) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(c.stats))
+	}
+	if got := c.stats["s1"].NoOfAssignAttempts; got != 2 {
+		t.Errorf("s1 assign attempts = %d, want 2", got)
+	}
+	if got := c.stats["s1"].CreatedByRole; got != "USER" {
+		t.Errorf("s1 created by role = %q, want USER", got)
+	}
+	if got := c.stats["s2"].RejectedReason; got != "no_tutors" {
+		t.Errorf("s2 rejected reason = %q, want no_tutors", got)
+	}
+	if got := c.unknownMetadata["DOMAINEVENT#SomethingNew"]; got != 1 {
+		t.Errorf("unknown metadata count = %d, want 1", got)
+	}
+}
+
+func TestCollectStatsSkipsSessionsOfUnknownEvents(t *testing.T) {
+	scanner := &fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+			rawItem("s2", "DOMAINEVENT#SomethingNew#b", "2022-03-01T10:00:01Z"),
+			rawItem("s2", "DOMAINEVENT#SomethingElse#c", "2022-03-01T10:00:02Z"),
+		},
+	}}
+
+	c, err := collectStats(context.Background(), scanner, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.stats) != 1 || c.stats["s1"] == nil {
+		t.Errorf("got sessions %v, want only s1", c.stats)
+	}
+	if len(c.unknownMetadata) != 2 {
+		t.Errorf("unknown metadata = %v, want both event types counted", c.unknownMetadata)
+	}
+}
+
+func TestCollectStatsSkipsMalformedItem(t *testing.T) {
+	malformed := rawItem("s2", SessionCreatedByUserEvent+"#b", "2022-03-01T10:00:01Z")
+	malformed["createdAt"] = &types.AttributeValueMemberL{Value: []types.AttributeValue{&types.AttributeValueMemberS{Value: "x"}}}
+	scanner := &fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+			malformed,
+			rawItem("s3", SessionCreatedByTutorEvent+"#c", "2022-03-01T10:00:02Z"),
+		},
+	}}
+
+	c, err := collectStats(context.Background(), scanner, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(c.stats) != 2 || c.stats["s1"] == nil || c.stats["s3"] == nil {
+		t.Errorf("got sessions %v, want s1 and s3", c.stats)
+	}
+	if len(c.itemErrors) != 1 {
+		t.Fatalf("got item errors %v, want one", c.itemErrors)
+	}
+	if msg := c.itemErrors[0].Error(); !strings.Contains(msg, "item 1 (id s2)") {
+		t.Errorf("item error %q doesn't point at the malformed item", msg)
+	}
+}
+
+func TestCollectStatsCountsOffsetTimestamps(t *testing.T) {
+	scanner := &fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T12:00:00+02:00"),
+			rawItem("s1", TutorAssignedToSessionEvent+"#b", "2022-03-01T10:00:05Z"),
+			rawItem("s2", SessionCreatedByUserEvent+"#c", "2022-03-01T10:00:00-00:00"),
+		},
+	}}
+
+	c, err := collectStats(context.Background(), scanner, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.offsetTimestamps != 2 {
+		t.Errorf("offset timestamps = %d, want 2", c.offsetTimestamps)
+	}
+}
+
+func TestCollectStatsScanError(t *testing.T) {
+	scanErr := errors.New("throttled")
+
+	_, err := collectStats(context.Background(), &fakeScanner{err: scanErr}, &dynamodb.ScanInput{}, Options{Segments: 2}.withDefaults(), nil)
+	if !errors.Is(err, scanErr) {
+		t.Fatalf("got error %v, want %v", err, scanErr)
+	}
+}
+
+func TestCollectStatsCountOnly(t *testing.T) {
+	scanner := &fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{
+			rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+			rawItem("s1", TutorAssignedToSessionEvent+"#b", "2022-03-01T10:00:05Z"),
+		},
+		{
+			rawItem("s2", "DOMAINEVENT#SomethingNew#c", "2022-03-01T11:00:01Z"),
+		},
+	}}
+
+	c, err := collectStats(context.Background(), scanner, &dynamodb.ScanInput{}, Options{Segments: 1, CountOnly: true}.withDefaults(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.items != 3 || c.sessionCount() != 2 {
+		t.Errorf("counted %d items, %d sessions; want 3, 2", c.items, c.sessionCount())
+	}
+	if len(c.stats) != 0 || len(c.unknownMetadata) != 0 {
+		t.Errorf("count-only run built stats: %d sessions, %d unknown metadata", len(c.stats), len(c.unknownMetadata))
+	}
+}
+
+func TestCollectorProgress(t *testing.T) {
+	c := newCollector(Options{}.withDefaults())
+	c.addPage(0, 1, []map[string]types.AttributeValue{
+		rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z"),
+		rawItem("s1", TutorAssignedToSessionEvent+"#b", "2022-03-01T10:00:05Z"),
+	})
+	c.addPage(0, 2, []map[string]types.AttributeValue{
+		rawItem("s2", SessionCreatedByTutorEvent+"#c", "2022-03-01T11:00:00Z"),
+	})
+
+	pages, items, sessions := c.progress()
+	if pages != 2 || items != 3 || sessions != 2 {
+		t.Errorf("progress = %d pages, %d items, %d sessions; want 2, 3, 2", pages, items, sessions)
+	}
+}
+
+// cancellingScanner serves its first page, then cancels the run as a signal
+// would and fails like the SDK does on a cancelled context.
+type cancellingScanner struct {
+	fakeScanner
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (s *cancellingScanner) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	s.calls++
+	if s.calls > 1 {
+		s.cancel()
+		return nil, ctx.Err()
+	}
+
+	return s.fakeScanner.Scan(ctx, params, optFns...)
+}
+
+func TestCollectStatsKeepsPartialResultsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	scanner := &cancellingScanner{cancel: cancel, fakeScanner: fakeScanner{pages: [][]map[string]types.AttributeValue{
+		{rawItem("s1", SessionCreatedByUserEvent+"#a", "2022-03-01T10:00:00Z")},
+		{rawItem("s2", SessionCreatedByUserEvent+"#b", "2022-03-01T11:00:00Z")},
+	}}}
+
+	c, err := collectStats(ctx, scanner, &dynamodb.ScanInput{}, Options{Segments: 1}.withDefaults(), nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if c == nil || len(c.stats) != 1 || c.stats["s1"] == nil {
+		t.Fatalf("want the first page's session kept, got %+v", c)
+	}
+}
+
+func TestNewScanInputTimeWindow(t *testing.T) {
+	tests := []struct {
+		timeSource    string
+		wantCondition string
+		wantEventTime bool
+	}{
+		{
+			timeSource:    TimeSourceIngestion,
+			wantCondition: "#createdAt > :createdAtFrom AND #createdAt < :createdAtTo AND ",
+		},
+		{
+			timeSource:    TimeSourceEvent,
+			wantCondition: "((#eventTime > :createdAtFrom AND #eventTime < :createdAtTo) OR (attribute_not_exists(#eventTime) AND #createdAt > :createdAtFrom AND #createdAt < :createdAtTo)) AND ",
+			wantEventTime: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timeSource, func(t *testing.T) {
+			input := newScanInput(Options{
+				Table:      "sessions",
+				From:       time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC),
+				To:         time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+				TimeSource: tt.timeSource,
+			})
+
+			if filter := *input.FilterExpression; !strings.HasPrefix(filter, tt.wantCondition) {
+				t.Errorf("filter = %q, want it to start with %q", filter, tt.wantCondition)
+			}
+			if got := input.ExpressionAttributeValues[":createdAtFrom"].(*types.AttributeValueMemberS).Value; got != "2022-03-01T00:00:00Z" {
+				t.Errorf(":createdAtFrom = %q", got)
+			}
+			if got := input.ExpressionAttributeValues[":createdAtTo"].(*types.AttributeValueMemberS).Value; got != "2022-04-01T00:00:00Z" {
+				t.Errorf(":createdAtTo = %q", got)
+			}
+			if strings.Contains(*input.FilterExpression, "#eventTime") != tt.wantEventTime {
+				t.Errorf("filter %q references #eventTime, want %v", *input.FilterExpression, tt.wantEventTime)
+			}
+		})
+	}
+}
+
+func TestNewScanInputKeyRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		wantFilter []string
+		wantValues map[string]string
+	}{
+		{name: "no range"},
+		{
+			name:       "start only",
+			start:      "s1",
+			wantFilter: []string{" AND #id >= :keyRangeStart"},
+			wantValues: map[string]string{":keyRangeStart": "s1"},
+		},
+		{
+			name:       "end only",
+			end:        "s5",
+			wantFilter: []string{" AND #id < :keyRangeEnd"},
+			wantValues: map[string]string{":keyRangeEnd": "s5"},
+		},
+		{
+			name:       "both bounds",
+			start:      "s1",
+			end:        "s5",
+			wantFilter: []string{" AND #id >= :keyRangeStart", " AND #id < :keyRangeEnd"},
+			wantValues: map[string]string{":keyRangeStart": "s1", ":keyRangeEnd": "s5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := newScanInput(Options{TimeSource: TimeSourceIngestion, KeyRangeStart: tt.start, KeyRangeEnd: tt.end})
+			filter := *input.FilterExpression
+
+			for _, clause := range tt.wantFilter {
+				if !strings.Contains(filter, clause) {
+					t.Errorf("filter %q is missing %q", filter, clause)
+				}
+			}
+			if len(tt.wantFilter) == 0 && strings.Contains(filter, "#id") {
+				t.Errorf("filter %q has a key range condition without a bound", filter)
+			}
+
+			for _, name := range []string{":keyRangeStart", ":keyRangeEnd"} {
+				v, ok := input.ExpressionAttributeValues[name]
+				want, wantOK := tt.wantValues[name]
+				if ok != wantOK {
+					t.Errorf("%s bound = %v, want %v (DynamoDB rejects unused values)", name, ok, wantOK)
+					continue
+				}
+				if ok && v.(*types.AttributeValueMemberS).Value != want {
+					t.Errorf("%s = %v, want %q", name, v, want)
+				}
+			}
+
+			// The projection always names #id, so the placeholder is there with
+			// or without a range; it must point at the key attribute.
+			if got := input.ExpressionAttributeNames["#id"]; got != "id" {
+				t.Errorf("#id = %q, want id", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,496 @@
+// Package sessionstats folds the session events of the sessions DynamoDB
+// table into one SessionStats row per session.
+//
+// CollectStats scans the table and returns the finished rows; MarshalToCSV
+// writes them out. Callers that read the items themselves fold each of them
+// into its session with FillStatBasedOnItem and, once all of a session's
+// items are in, call Finalize on it to get the same row.
+package sessionstats
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/gocarina/gocsv"
+)
+
+// SessionStats is the row exported per session.
+type SessionStats struct {
+	ID                  string `csv:"id" json:"id"`
+	Market              string `csv:"market" json:"market"`
+	NoOfAssignAttempts  int    `csv:"no_of_assign_attempts" json:"no_of_assign_attempts"`
+	NoOfQuestionUpdates int    `csv:"no_of_question_updates" json:"no_of_question_updates"`
+	// UnassignedOn* count how often a tutor was unassigned, by cause.
+	UnassignedOnConfirmationTimeout int    `csv:"unassigned_on_confirmation_timeout" json:"unassigned_on_confirmation_timeout"`
+	UnassignedOnTutorDisconnected   int    `csv:"unassigned_on_tutor_disconnected" json:"unassigned_on_tutor_disconnected"`
+	CreatedAt                       string `csv:"created_at" json:"created_at"`
+	CreatedByRole                   string `csv:"created_by_role" json:"created_by_role"`
+	// CreationConflict is set when more than one creation event was seen
+	// for the session; CreatedAt and CreatedByRole then hold the earliest.
+	CreationConflict bool   `csv:"creation_conflict" json:"creation_conflict"`
+	RejectedAt       string `csv:"rejected_at" json:"rejected_at"`
+	RejectedReason   string `csv:"rejected_reason" json:"rejected_reason"`
+	ClosedAt         string `csv:"closed_at" json:"closed_at"`
+	ClosedReason     string `csv:"closed_reason" json:"closed_reason"`
+	ConfirmedAt      string `csv:"confirmed_at" json:"confirmed_at"`
+	// LastAssignedAt is the latest TutorAssignedToSession event.
+	LastAssignedAt string `csv:"last_assigned_at" json:"last_assigned_at"`
+	// Rating given by the user, nil (blank) when the session was never rated.
+	Rating *int `csv:"rating" json:"rating"`
+
+	// Derived after all events are folded in, nil (blank) when the needed
+	// timestamps are missing or out of order.
+	TimeToConfirmSeconds   *int `csv:"time_to_confirm_seconds" json:"time_to_confirm_seconds"`
+	SessionDurationSeconds *int `csv:"session_duration_seconds" json:"session_duration_seconds"`
+	// SecondsFromLastAssignToEnd runs from LastAssignedAt to the close or
+	// rejection that ended the session, the one Status is based on.
+	SecondsFromLastAssignToEnd *int `csv:"seconds_from_last_assign_to_end" json:"seconds_from_last_assign_to_end"`
+	// PartialWindow marks sessions whose creation happened before the scan
+	// window: later events were seen but no creation event, so CreatedAt is empty.
+	PartialWindow bool `csv:"partial_window" json:"partial_window"`
+	// Status is the session's terminal state, see sessionStatus.
+	// StatusConflict is set when it was both rejected and closed; Status then
+	// follows whichever happened first.
+	Status         string `csv:"status" json:"status"`
+	StatusConflict bool   `csv:"status_conflict" json:"status_conflict"`
+	// Unterminated marks confirmed sessions with neither a close nor a
+	// rejection, likely stuck or leaked ones. Sessions still running when the
+	// window ends, or closed just after it, are flagged too, so expect false
+	// positives near To.
+	Unterminated bool `csv:"unterminated" json:"unterminated"`
+
+	// assignAttempts holds the attempts counted in NoOfAssignAttempts, so a
+	// replayed assign event isn't counted twice, each with the earliest
+	// timestamp it was seen at. It isn't exported to any output; checkpoints
+	// save it separately.
+	assignAttempts map[string]string
+}
+
+// DynamoItem is a session table item as read by the scan: the SESSION
+// metadata item or one domain event.
+type DynamoItem struct {
+	ID        string `dynamodbav:"id"`
+	Metadata  string `dynamodbav:"metadata"`
+	CreatedAt string `dynamodbav:"createdAt"`
+	EventTime string `dynamodbav:"eventTime"`
+	Market    string `dynamodbav:"market"`
+	// Rating is only set on SessionRatedByUser events.
+	Rating *int `dynamodbav:"rating"`
+}
+
+// Time sources, selecting the timestamp used for the scan window filter and
+// the time columns.
+const (
+	// TimeSourceIngestion uses the item's createdAt, i.e. when it was written to the table.
+	TimeSourceIngestion = "ingestion"
+	// TimeSourceEvent uses the event's own eventTime, falling back to createdAt
+	// for items that don't carry one (e.g. the SESSION metadata item).
+	TimeSourceEvent = "event"
+)
+
+// timeAttributes maps a time source to the item attribute holding its timestamp.
+var timeAttributes = map[string]string{
+	TimeSourceIngestion: "createdAt",
+	TimeSourceEvent:     "eventTime",
+}
+
+// projectedAttributes lists the attributes the scan fetches, taken from the
+// dynamodbav tags of DynamoItem so a new field can't be silently left out of
+// the projection.
+var projectedAttributes = dynamoAttributes(reflect.TypeOf(DynamoItem{}))
+
+// dynamoAttributes returns the attribute names of the dynamodbav-tagged fields
+// of the struct type t, in field order. Untagged fields use the field name,
+// like attributevalue does; fields tagged "-" are skipped.
+func dynamoAttributes(t reflect.Type) []string {
+	var attributes []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("dynamodbav"), ",")[0]
+		if name == "-" || f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		attributes = append(attributes, name)
+	}
+
+	return attributes
+}
+
+// projection builds a ProjectionExpression over attributes in which every
+// attribute is referenced through a #name placeholder, so reserved words such
+// as "name" or "status" can be projected too. The placeholders are returned
+// for ExpressionAttributeNames.
+func projection(attributes []string) (string, map[string]string) {
+	placeholders := make([]string, len(attributes))
+	names := make(map[string]string, len(attributes))
+	for i, a := range attributes {
+		placeholders[i] = "#" + a
+		names["#"+a] = a
+	}
+
+	return strings.Join(placeholders, ","), names
+}
+
+// Time returns the item's timestamp for the given time source.
+func (item DynamoItem) Time(timeSource string) string {
+	if timeSource == TimeSourceEvent && item.EventTime != "" {
+		return item.EventTime
+	}
+
+	return item.CreatedAt
+}
+
+// Metadata sort key prefixes of the items the default event mappings know.
+const (
+	SessionMetadata                                      = "SESSION"
+	SessionCreatedByUserEvent                            = "DOMAINEVENT#SessionCreatedByUser"
+	SessionCreatedByTutorEvent                           = "DOMAINEVENT#SessionCreatedByTutor"
+	SessionConfirmedByTutorEvent                         = "DOMAINEVENT#SessionConfirmedByTutor"
+	SessionRejectedByUserEvent                           = "DOMAINEVENT#SessionRejectedByUser"
+	SessionRejectedOnMatchingTimeoutEvent                = "DOMAINEVENT#SessionRejectedOnMatchingTimeout"
+	SessionRejectedOnNoTutorsEvent                       = "DOMAINEVENT#SessionRejectedOnNoTutors"
+	SessionClosedByUserEvent                             = "DOMAINEVENT#SessionClosedByUser"
+	SessionClosedByTutorEvent                            = "DOMAINEVENT#SessionClosedByTutor"
+	SessionClosedOnTutorDisconnectedEvent                = "DOMAINEVENT#SessionClosedOnTutorDisconnected"
+	SessionRatedByUserEvent                              = "DOMAINEVENT#SessionRatedByUser"
+	SessionReportedByTutorEvent                          = "DOMAINEVENT#SessionReportedByTutor"
+	QuestionUpdatedEvent                                 = "DOMAINEVENT#QuestionUpdated"
+	TutorUnassignedFromSessionOnConfirmationTimeoutEvent = "DOMAINEVENT#TutorUnassignedFromSessionOnConfirmationTimeout"
+	TutorUnassignedFromSessionOnTutorDisconnectedEvent   = "DOMAINEVENT#TutorUnassignedFromSessionOnTutorDisconnected"
+	TutorAssignedToSessionEvent                          = "DOMAINEVENT#TutorAssignedToSession"
+)
+
+var errUnknownMetadata = errors.New("unknown metadata")
+
+// metadataPrefix strips the per-event suffix (e.g. the event uuid) from a
+// metadata sort key, leaving the event type: "DOMAINEVENT#SessionCreatedByUser".
+func metadataPrefix(metadata string) string {
+	parts := strings.SplitN(metadata, "#", 3)
+	if len(parts) < 2 {
+		return metadata
+	}
+
+	return parts[0] + "#" + parts[1]
+}
+
+// isBefore reports whether timestamp a is earlier than b, comparing the
+// strings when either doesn't parse.
+func isBefore(a, b string) bool {
+	ta, errA := time.Parse(time.RFC3339, a)
+	tb, errB := time.Parse(time.RFC3339, b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+
+	return ta.Before(tb)
+}
+
+// setCreation records a creation event. A session should have exactly one;
+// when another one shows up the conflict is flagged and the earliest creation
+// wins, whichever order the scan returned them in.
+func setCreation(stats *SessionStats, at, role string) {
+	if stats.CreatedByRole != "" {
+		stats.CreationConflict = true
+		if !isBefore(at, stats.CreatedAt) {
+			return
+		}
+	}
+
+	stats.CreatedAt = at
+	stats.CreatedByRole = role
+}
+
+// addAssignAttempt counts a TutorAssignedToSession event unless the same
+// attempt was seen before. The event store sometimes replays these events; a
+// replay gets a new sort key and ingestion time but keeps the event's own
+// eventTime, so the distinct eventTimes are the attempts. Deduplication
+// therefore needs eventTime: an item written without one can't be told apart
+// from a replay and is always counted, keyed by its (unique) metadata. at, the
+// event's timestamp for the chosen time source, moves LastAssignedAt forward
+// for new attempts only: a replay can carry a much later ingestion time, and
+// the scan may return it before the original, so an attempt keeps the
+// earliest at of its copies.
+func addAssignAttempt(stats *SessionStats, item DynamoItem, at string) {
+	attempt := item.EventTime
+	if attempt == "" {
+		attempt = item.Metadata
+	}
+
+	if first, seen := stats.assignAttempts[attempt]; seen {
+		if isBefore(at, first) {
+			stats.assignAttempts[attempt] = at
+			stats.LastAssignedAt = latestAssignment(stats.assignAttempts)
+		}
+		return
+	}
+	if stats.assignAttempts == nil {
+		stats.assignAttempts = make(map[string]string)
+	}
+
+	stats.assignAttempts[attempt] = at
+	stats.NoOfAssignAttempts += 1
+	if stats.LastAssignedAt == "" || isBefore(stats.LastAssignedAt, at) {
+		stats.LastAssignedAt = at
+	}
+}
+
+// latestAssignment returns the latest timestamp of attempts.
+func latestAssignment(attempts map[string]string) string {
+	var latest string
+	for _, at := range attempts {
+		if latest == "" || isBefore(latest, at) {
+			latest = at
+		}
+	}
+
+	return latest
+}
+
+// FillStatBasedOnItem folds a single item into stats using the default event
+// mappings. Items of an event type it doesn't know return an error and leave
+// stats untouched. The derived columns are only computed by Finalize, once
+// all of a session's events are in.
+func FillStatBasedOnItem(stats *SessionStats, item DynamoItem, timeSource string) error {
+	return fillStats(stats, item, timeSource, defaultEventMappings)
+}
+
+// fillStats folds a single item into stats, using the action of the first of
+// mappings whose prefix its metadata starts with. Items of an event type it
+// doesn't know return an error wrapping errUnknownMetadata.
+func fillStats(stats *SessionStats, item DynamoItem, timeSource string, mappings []EventMapping) error {
+	for _, m := range mappings {
+		if strings.HasPrefix(item.Metadata, m.Prefix) {
+			eventActions[m.Action](stats, item, item.Time(timeSource), m.Value)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w %q", errUnknownMetadata, item.Metadata)
+}
+
+// secondsBetween returns the whole seconds from start to end, or nil when
+// either timestamp is missing or unparseable, or end is before start.
+func secondsBetween(start, end string) *int {
+	if start == "" || end == "" {
+		return nil
+	}
+
+	s, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil
+	}
+	e, err := time.Parse(time.RFC3339, end)
+	if err != nil {
+		return nil
+	}
+
+	if e.Before(s) {
+		return nil
+	}
+
+	seconds := int(e.Sub(s) / time.Second)
+	return &seconds
+}
+
+// normalizeTimestamps rewrites the session's timestamps in canonical UTC
+// RFC3339 form. Values that don't parse are cleared, so they can't break
+// downstream loaders, and returned as errors.
+func normalizeTimestamps(stats *SessionStats) []error {
+	var errs []error
+
+	fields := []struct {
+		name  string
+		value *string
+	}{
+		{"created_at", &stats.CreatedAt},
+		{"rejected_at", &stats.RejectedAt},
+		{"closed_at", &stats.ClosedAt},
+		{"confirmed_at", &stats.ConfirmedAt},
+		{"last_assigned_at", &stats.LastAssignedAt},
+	}
+	for _, f := range fields {
+		if *f.value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, *f.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("session %s: invalid %s %q", stats.ID, f.name, *f.value))
+			*f.value = ""
+			continue
+		}
+
+		*f.value = t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return errs
+}
+
+// partialWindow reports whether later events of the session were seen but its
+// creation wasn't, i.e. it was created before the window.
+func partialWindow(stats *SessionStats) bool {
+	return stats.CreatedAt == "" &&
+		(stats.ConfirmedAt != "" || stats.RejectedAt != "" || stats.ClosedAt != "")
+}
+
+// Finalize completes a session folded with FillStatBasedOnItem: it rewrites
+// its timestamps in canonical UTC form, clearing those that don't parse, and
+// computes the derived columns (Status, the durations, PartialWindow,
+// Unterminated). The returned errors describe the cleared timestamps. It has
+// to run once, after the session's last item.
+func Finalize(stats *SessionStats) []error {
+	// PartialWindow goes by the events folded in: a CreatedAt cleared for not
+	// parsing still means the creation was seen in the window.
+	stats.PartialWindow = partialWindow(stats)
+	errs := normalizeTimestamps(stats)
+	finalizeStats(stats)
+
+	return errs
+}
+
+// finalizeStats computes the fields derived from a session's complete event
+// history. It has to run after the whole scan, since events arrive in no
+// particular order.
+func finalizeStats(stats *SessionStats) {
+	stats.TimeToConfirmSeconds = secondsBetween(stats.CreatedAt, stats.ConfirmedAt)
+
+	if stats.ConfirmedAt != "" {
+		stats.SessionDurationSeconds = secondsBetween(stats.ConfirmedAt, stats.ClosedAt)
+	} else {
+		stats.SessionDurationSeconds = secondsBetween(stats.CreatedAt, stats.ClosedAt)
+	}
+
+	stats.Status, stats.StatusConflict = sessionStatus(stats)
+	stats.Unterminated = stats.ConfirmedAt != "" && stats.ClosedAt == "" && stats.RejectedAt == ""
+
+	switch stats.Status {
+	case StatusClosed:
+		stats.SecondsFromLastAssignToEnd = secondsBetween(stats.LastAssignedAt, stats.ClosedAt)
+	case StatusRejected:
+		stats.SecondsFromLastAssignToEnd = secondsBetween(stats.LastAssignedAt, stats.RejectedAt)
+	default:
+		stats.SecondsFromLastAssignToEnd = nil
+	}
+}
+
+// Values of SessionStats.Status.
+const (
+	StatusRejected      = "rejected"
+	StatusClosed        = "closed"
+	StatusConfirmedOpen = "confirmed_open"
+	StatusCreatedOnly   = "created_only"
+	// StatusUnknown is a session with none of the above events in the window,
+	// e.g. only assignments of a session created before it.
+	StatusUnknown = "unknown"
+)
+
+// sessionStatus resolves the terminal state of a session from the timestamps
+// set so far, by precedence rejected > closed > confirmed > created. A session
+// that was both rejected and closed shouldn't exist; conflict is reported for
+// it and the earlier of the two events wins.
+func sessionStatus(stats *SessionStats) (status string, conflict bool) {
+	switch {
+	case stats.RejectedAt != "" && stats.ClosedAt != "":
+		if isBefore(stats.ClosedAt, stats.RejectedAt) {
+			return StatusClosed, true
+		}
+		return StatusRejected, true
+	case stats.RejectedAt != "":
+		return StatusRejected, false
+	case stats.ClosedAt != "":
+		return StatusClosed, false
+	case stats.ConfirmedAt != "":
+		return StatusConfirmedOpen, false
+	case stats.CreatedAt != "":
+		return StatusCreatedOnly, false
+	default:
+		return StatusUnknown, false
+	}
+}
+
+// unmarshalItems decodes a page of items. When the page fails to decode as a
+// whole it retries item by item, so a single malformed item costs only itself;
+// the returned errors describe the items that were skipped.
+func unmarshalItems(raw []map[string]types.AttributeValue) ([]DynamoItem, []error) {
+	var items []DynamoItem
+	if err := attributevalue.UnmarshalListOfMaps(raw, &items); err == nil {
+		return items, nil
+	}
+
+	items = make([]DynamoItem, 0, len(raw))
+	var errs []error
+
+	for i, r := range raw {
+		var item DynamoItem
+		if err := attributevalue.UnmarshalMap(r, &item); err != nil {
+			id := "<unknown>"
+			if v, ok := r["id"].(*types.AttributeValueMemberS); ok {
+				id = v.Value
+			}
+			errs = append(errs, fmt.Errorf("item %d (id %s): %w", i, id, err))
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	return items, errs
+}
+
+// hasNonUTCOffset reports whether ts is a valid RFC3339 timestamp written with
+// an explicit offset (e.g. +02:00) instead of Z. The scan filter compares
+// timestamps as strings, which is only correct when all of them are in Z form.
+func hasNonUTCOffset(ts string) bool {
+	if _, err := time.Parse(time.RFC3339, ts); err != nil {
+		return false
+	}
+
+	return !strings.HasSuffix(ts, "Z")
+}
+
+// Sorted returns the sessions ordered by CreatedAt, oldest first, then by
+// ID, so repeated exports of the same data are identical. Sessions without a
+// parseable CreatedAt come first.
+func Sorted(statsMap map[string]*SessionStats) []*SessionStats {
+	stats := make([]*SessionStats, 0, len(statsMap))
+	createdAt := make(map[*SessionStats]time.Time, len(statsMap))
+
+	for _, v := range statsMap {
+		stats = append(stats, v)
+		// Parsed rather than compared as strings: fractional seconds and
+		// offsets make RFC3339 strings sort out of chronological order.
+		if t, err := time.Parse(time.RFC3339, v.CreatedAt); err == nil {
+			createdAt[v] = t
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		ti, tj := createdAt[stats[i]], createdAt[stats[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return stats[i].ID < stats[j].ID
+	})
+
+	return stats
+}
+
+// MarshalToCSV writes the sessions to w as CSV, one row at a time, so the
+// output is never materialised as a whole. Peak memory is therefore the
+// stats map itself (every session of the window, which has to be held until
+// the scan ends since a session's events can arrive on any page) plus a slice
+// of pointers to its values, not the size of the CSV.
+func MarshalToCSV(w io.Writer, statsMap map[string]*SessionStats) error {
+	return gocsv.Marshal(Sorted(statsMap), w)
+}
@@ -0,0 +1,672 @@
+package sessionstats
+
+import (
+	"encoding/csv"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFillStatBasedOnItem(t *testing.T) {
+	const at = "2022-03-01T10:00:00Z"
+
+	tests := []struct {
+		name  string
+		start SessionStats
+		item  DynamoItem
+		want  SessionStats
+	}{
+		{
+			name: "session metadata",
+			item: DynamoItem{Metadata: SessionMetadata, CreatedAt: at, Market: "pl"},
+			want: SessionStats{Market: "pl"},
+		},
+		{
+			name: "created by user",
+			item: DynamoItem{Metadata: SessionCreatedByUserEvent + "#1", CreatedAt: at},
+			want: SessionStats{CreatedAt: at, CreatedByRole: "USER"},
+		},
+		{
+			name: "created by tutor",
+			item: DynamoItem{Metadata: SessionCreatedByTutorEvent + "#1", CreatedAt: at},
+			want: SessionStats{CreatedAt: at, CreatedByRole: "TUTOR"},
+		},
+		{
+			name: "confirmed by tutor",
+			item: DynamoItem{Metadata: SessionConfirmedByTutorEvent + "#1", CreatedAt: at},
+			want: SessionStats{ConfirmedAt: at},
+		},
+		{
+			name: "rejected by user",
+			item: DynamoItem{Metadata: SessionRejectedByUserEvent + "#1", CreatedAt: at},
+			want: SessionStats{RejectedAt: at, RejectedReason: "user"},
+		},
+		{
+			name: "rejected on matching timeout",
+			item: DynamoItem{Metadata: SessionRejectedOnMatchingTimeoutEvent + "#1", CreatedAt: at},
+			want: SessionStats{RejectedAt: at, RejectedReason: "matching_timeout"},
+		},
+		{
+			name: "rejected on no tutors",
+			item: DynamoItem{Metadata: SessionRejectedOnNoTutorsEvent + "#1", CreatedAt: at},
+			want: SessionStats{RejectedAt: at, RejectedReason: "no_tutors"},
+		},
+		{
+			name: "closed by tutor",
+			item: DynamoItem{Metadata: SessionClosedByTutorEvent + "#1", CreatedAt: at},
+			want: SessionStats{ClosedAt: at, ClosedReason: "tutor"},
+		},
+		{
+			name: "closed by user",
+			item: DynamoItem{Metadata: SessionClosedByUserEvent + "#1", CreatedAt: at},
+			want: SessionStats{ClosedAt: at, ClosedReason: "user"},
+		},
+		{
+			name: "closed on tutor disconnected",
+			item: DynamoItem{Metadata: SessionClosedOnTutorDisconnectedEvent + "#1", CreatedAt: at},
+			want: SessionStats{ClosedAt: at, ClosedReason: "tutor_disconnected"},
+		},
+		{
+			name:  "tutor assigned increments attempts",
+			item:  DynamoItem{Metadata: TutorAssignedToSessionEvent + "#2", CreatedAt: at},
+			start: SessionStats{NoOfAssignAttempts: 1},
+			want: SessionStats{
+				NoOfAssignAttempts: 2,
+				LastAssignedAt:     at,
+				assignAttempts:     map[string]string{TutorAssignedToSessionEvent + "#2": at},
+			},
+		},
+		{
+			name: "rated by user",
+			item: DynamoItem{Metadata: SessionRatedByUserEvent + "#1", CreatedAt: at, Rating: intPtr(4)},
+			want: SessionStats{Rating: intPtr(4)},
+		},
+		{
+			name: "reported by tutor is ignored",
+			item: DynamoItem{Metadata: SessionReportedByTutorEvent + "#1", CreatedAt: at},
+		},
+		{
+			name:  "question updated increments updates",
+			item:  DynamoItem{Metadata: QuestionUpdatedEvent + "#1", CreatedAt: at},
+			start: SessionStats{NoOfQuestionUpdates: 2},
+			want:  SessionStats{NoOfQuestionUpdates: 3},
+		},
+		{
+			name:  "unassigned on confirmation timeout increments its counter",
+			item:  DynamoItem{Metadata: TutorUnassignedFromSessionOnConfirmationTimeoutEvent + "#1", CreatedAt: at},
+			start: SessionStats{UnassignedOnConfirmationTimeout: 1},
+			want:  SessionStats{UnassignedOnConfirmationTimeout: 2},
+		},
+		{
+			name: "unassigned on tutor disconnected increments its counter",
+			item: DynamoItem{Metadata: TutorUnassignedFromSessionOnTutorDisconnectedEvent + "#1", CreatedAt: at},
+			want: SessionStats{UnassignedOnTutorDisconnected: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.start
+			if err := FillStatBasedOnItem(&got, tt.item, TimeSourceIngestion); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFillStatBasedOnItemTimeSources(t *testing.T) {
+	// Ingestion lags every event by a minute; the confirmation was written
+	// without eventTime and falls back to createdAt under event time too.
+	items := []DynamoItem{
+		{Metadata: SessionCreatedByUserEvent + "#a", EventTime: "2022-03-01T10:00:00Z", CreatedAt: "2022-03-01T10:01:00Z"},
+		{Metadata: SessionConfirmedByTutorEvent + "#b", CreatedAt: "2022-03-01T10:01:30Z"},
+		{Metadata: SessionClosedByTutorEvent + "#c", EventTime: "2022-03-01T10:10:00Z", CreatedAt: "2022-03-01T10:11:00Z"},
+	}
+
+	tests := []struct {
+		timeSource   string
+		want         SessionStats
+		wantConfirm  *int
+		wantDuration *int
+	}{
+		{
+			timeSource:   TimeSourceIngestion,
+			want:         SessionStats{CreatedAt: "2022-03-01T10:01:00Z", ConfirmedAt: "2022-03-01T10:01:30Z", ClosedAt: "2022-03-01T10:11:00Z"},
+			wantConfirm:  intPtr(30),
+			wantDuration: intPtr(570),
+		},
+		{
+			timeSource:   TimeSourceEvent,
+			want:         SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:01:30Z", ClosedAt: "2022-03-01T10:10:00Z"},
+			wantConfirm:  intPtr(90),
+			wantDuration: intPtr(510),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.timeSource, func(t *testing.T) {
+			var s SessionStats
+			for _, item := range items {
+				if err := FillStatBasedOnItem(&s, item, tt.timeSource); err != nil {
+					t.Fatal(err)
+				}
+			}
+			finalizeStats(&s)
+
+			if s.CreatedAt != tt.want.CreatedAt || s.ConfirmedAt != tt.want.ConfirmedAt || s.ClosedAt != tt.want.ClosedAt {
+				t.Errorf("got created %s, confirmed %s, closed %s, want %s, %s, %s",
+					s.CreatedAt, s.ConfirmedAt, s.ClosedAt, tt.want.CreatedAt, tt.want.ConfirmedAt, tt.want.ClosedAt)
+			}
+			if !reflect.DeepEqual(s.TimeToConfirmSeconds, tt.wantConfirm) {
+				t.Errorf("time to confirm = %v, want %v", derefInt(s.TimeToConfirmSeconds), derefInt(tt.wantConfirm))
+			}
+			if !reflect.DeepEqual(s.SessionDurationSeconds, tt.wantDuration) {
+				t.Errorf("duration = %v, want %v", derefInt(s.SessionDurationSeconds), derefInt(tt.wantDuration))
+			}
+		})
+	}
+}
+
+func TestFinalize(t *testing.T) {
+	var s SessionStats
+	for _, item := range []DynamoItem{
+		{Metadata: SessionCreatedByUserEvent + "#a", CreatedAt: "2022-03-01T12:00:00+02:00"},
+		{Metadata: TutorAssignedToSessionEvent + "#b", CreatedAt: "2022-03-01T10:00:10Z"},
+		{Metadata: SessionConfirmedByTutorEvent + "#c", CreatedAt: "2022-03-01T10:00:30Z"},
+		{Metadata: SessionClosedByUserEvent + "#d", CreatedAt: "yesterday"},
+	} {
+		if err := FillStatBasedOnItem(&s, item, TimeSourceIngestion); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := Finalize(&s)
+
+	if len(errs) != 1 {
+		t.Errorf("got %v, want one error for the closed_at that doesn't parse", errs)
+	}
+	if s.CreatedAt != "2022-03-01T10:00:00Z" || s.ClosedAt != "" {
+		t.Errorf("timestamps not normalized: created %q, closed %q", s.CreatedAt, s.ClosedAt)
+	}
+	if s.Status != StatusConfirmedOpen || !s.Unterminated {
+		t.Errorf("status = %q, unterminated %v, want %q and unterminated", s.Status, s.Unterminated, StatusConfirmedOpen)
+	}
+	if !reflect.DeepEqual(s.TimeToConfirmSeconds, intPtr(30)) {
+		t.Errorf("time to confirm = %v, want 30", derefInt(s.TimeToConfirmSeconds))
+	}
+}
+
+func TestFillStatBasedOnItemUnknownMetadata(t *testing.T) {
+	stats := SessionStats{ID: "s1"}
+
+	err := FillStatBasedOnItem(&stats, DynamoItem{ID: "s1", Metadata: "DOMAINEVENT#SomethingNew#1"}, TimeSourceIngestion)
+	if !errors.Is(err, errUnknownMetadata) {
+		t.Fatalf("got error %v, want errUnknownMetadata", err)
+	}
+
+	if !reflect.DeepEqual(stats, SessionStats{ID: "s1"}) {
+		t.Errorf("stats changed on unknown item: %+v", stats)
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestFinalizeStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		stats        SessionStats
+		wantConfirm  *int
+		wantDuration *int
+		wantPartial  bool
+	}{
+		{
+			name:         "confirmed and closed",
+			stats:        SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:00:30Z", ClosedAt: "2022-03-01T10:10:30Z"},
+			wantConfirm:  intPtr(30),
+			wantDuration: intPtr(600),
+		},
+		{
+			name:         "closed without confirmation",
+			stats:        SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ClosedAt: "2022-03-01T10:01:00Z"},
+			wantDuration: intPtr(60),
+		},
+		{
+			name:        "confirmed after closed",
+			stats:       SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:05:00Z", ClosedAt: "2022-03-01T10:01:00Z"},
+			wantConfirm: intPtr(300),
+		},
+		{
+			name:        "created before the window",
+			stats:       SessionStats{RejectedAt: "2022-03-01T10:00:00Z"},
+			wantPartial: true,
+		},
+		{
+			name:  "only created",
+			stats: SessionStats{CreatedAt: "2022-03-01T10:00:00Z"},
+		},
+		{
+			name:  "creation with a malformed timestamp",
+			stats: SessionStats{CreatedAt: "2022-03-01 10:00", RejectedAt: "2022-03-01T10:01:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.stats
+			Finalize(&s)
+
+			if !reflect.DeepEqual(s.TimeToConfirmSeconds, tt.wantConfirm) {
+				t.Errorf("time to confirm = %v, want %v", derefInt(s.TimeToConfirmSeconds), derefInt(tt.wantConfirm))
+			}
+			if !reflect.DeepEqual(s.SessionDurationSeconds, tt.wantDuration) {
+				t.Errorf("duration = %v, want %v", derefInt(s.SessionDurationSeconds), derefInt(tt.wantDuration))
+			}
+			if s.PartialWindow != tt.wantPartial {
+				t.Errorf("partial window = %v, want %v", s.PartialWindow, tt.wantPartial)
+			}
+		})
+	}
+}
+
+func TestSecondsFromLastAssignToEnd(t *testing.T) {
+	tests := []struct {
+		name  string
+		items []DynamoItem
+		want  *int
+	}{
+		{
+			name: "closed after the last of two assignments",
+			items: []DynamoItem{
+				{Metadata: TutorAssignedToSessionEvent + "#b", CreatedAt: "2022-03-01T10:02:00Z"},
+				{Metadata: TutorAssignedToSessionEvent + "#a", CreatedAt: "2022-03-01T10:00:00Z"},
+				{Metadata: SessionClosedByUserEvent + "#c", CreatedAt: "2022-03-01T10:05:00Z"},
+			},
+			want: intPtr(180),
+		},
+		{
+			name: "rejected after an assignment",
+			items: []DynamoItem{
+				{Metadata: TutorAssignedToSessionEvent + "#a", CreatedAt: "2022-03-01T10:00:00Z"},
+				{Metadata: SessionRejectedOnMatchingTimeoutEvent + "#b", CreatedAt: "2022-03-01T10:00:45Z"},
+			},
+			want: intPtr(45),
+		},
+		{
+			name: "replayed assignment ingested after the close",
+			items: []DynamoItem{
+				{Metadata: SessionCreatedByUserEvent + "#a", CreatedAt: "2022-03-01T10:00:00Z"},
+				{Metadata: TutorAssignedToSessionEvent + "#b", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T10:00:05Z"},
+				{Metadata: SessionClosedByUserEvent + "#c", CreatedAt: "2022-03-01T10:10:00Z"},
+				{Metadata: TutorAssignedToSessionEvent + "#d", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T12:00:00Z"},
+			},
+			want: intPtr(595),
+		},
+		{
+			name: "replayed assignment read before the original",
+			items: []DynamoItem{
+				{Metadata: TutorAssignedToSessionEvent + "#d", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T12:00:00Z"},
+				{Metadata: TutorAssignedToSessionEvent + "#b", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T10:00:05Z"},
+				{Metadata: SessionClosedByUserEvent + "#c", CreatedAt: "2022-03-01T10:10:00Z"},
+			},
+			want: intPtr(595),
+		},
+		{
+			name: "never assigned",
+			items: []DynamoItem{
+				{Metadata: SessionRejectedOnNoTutorsEvent + "#a", CreatedAt: "2022-03-01T10:00:45Z"},
+			},
+		},
+		{
+			name: "still open",
+			items: []DynamoItem{
+				{Metadata: TutorAssignedToSessionEvent + "#a", CreatedAt: "2022-03-01T10:00:00Z"},
+				{Metadata: SessionConfirmedByTutorEvent + "#b", CreatedAt: "2022-03-01T10:00:10Z"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s SessionStats
+			for _, item := range tt.items {
+				if err := FillStatBasedOnItem(&s, item, TimeSourceIngestion); err != nil {
+					t.Fatal(err)
+				}
+			}
+			finalizeStats(&s)
+
+			if !reflect.DeepEqual(s.SecondsFromLastAssignToEnd, tt.want) {
+				t.Errorf("seconds from last assign to end = %v, want %v", derefInt(s.SecondsFromLastAssignToEnd), derefInt(tt.want))
+			}
+		})
+	}
+}
+
+func TestSessionStatus(t *testing.T) {
+	tests := []struct {
+		name         string
+		stats        SessionStats
+		wantStatus   string
+		wantConflict bool
+	}{
+		{
+			name:       "rejected",
+			stats:      SessionStats{CreatedAt: "2022-03-01T10:00:00Z", RejectedAt: "2022-03-01T10:01:00Z"},
+			wantStatus: StatusRejected,
+		},
+		{
+			name:       "confirmed and closed",
+			stats:      SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:00:30Z", ClosedAt: "2022-03-01T10:10:30Z"},
+			wantStatus: StatusClosed,
+		},
+		{
+			name:       "confirmed, still open",
+			stats:      SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:00:30Z"},
+			wantStatus: StatusConfirmedOpen,
+		},
+		{
+			name:       "only created",
+			stats:      SessionStats{CreatedAt: "2022-03-01T10:00:00Z"},
+			wantStatus: StatusCreatedOnly,
+		},
+		{
+			name:       "no lifecycle events",
+			stats:      SessionStats{NoOfAssignAttempts: 1},
+			wantStatus: StatusUnknown,
+		},
+		{
+			name:         "closed before rejected",
+			stats:        SessionStats{ClosedAt: "2022-03-01T10:01:00Z", RejectedAt: "2022-03-01T10:02:00Z"},
+			wantStatus:   StatusClosed,
+			wantConflict: true,
+		},
+		{
+			name:         "rejected before closed",
+			stats:        SessionStats{ClosedAt: "2022-03-01T10:02:00Z", RejectedAt: "2022-03-01T10:01:00Z"},
+			wantStatus:   StatusRejected,
+			wantConflict: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.stats
+			finalizeStats(&s)
+
+			if s.Status != tt.wantStatus || s.StatusConflict != tt.wantConflict {
+				t.Errorf("status = %q (conflict %v), want %q (conflict %v)", s.Status, s.StatusConflict, tt.wantStatus, tt.wantConflict)
+			}
+		})
+	}
+}
+
+func TestUnterminated(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats SessionStats
+		want  bool
+	}{
+		{
+			name:  "confirmed, never closed",
+			stats: SessionStats{CreatedAt: "2022-03-01T10:00:00Z", ConfirmedAt: "2022-03-01T10:00:30Z"},
+			want:  true,
+		},
+		{
+			name:  "confirmed before the window, never closed",
+			stats: SessionStats{ConfirmedAt: "2022-03-01T10:00:30Z"},
+			want:  true,
+		},
+		{
+			name:  "confirmed and closed",
+			stats: SessionStats{ConfirmedAt: "2022-03-01T10:00:30Z", ClosedAt: "2022-03-01T10:10:30Z"},
+		},
+		{
+			name:  "confirmed and rejected",
+			stats: SessionStats{ConfirmedAt: "2022-03-01T10:00:30Z", RejectedAt: "2022-03-01T10:01:00Z"},
+		},
+		{
+			name:  "never confirmed",
+			stats: SessionStats{CreatedAt: "2022-03-01T10:00:00Z"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.stats
+			finalizeStats(&s)
+
+			if s.Unterminated != tt.want {
+				t.Errorf("unterminated = %v, want %v", s.Unterminated, tt.want)
+			}
+		})
+	}
+}
+
+func derefInt(v *int) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	return *v
+}
+
+func TestNormalizeTimestamps(t *testing.T) {
+	stats := SessionStats{
+		ID:          "s1",
+		CreatedAt:   "2022-03-01T12:00:00+02:00",
+		ConfirmedAt: "2022-03-01T10:00:30.5Z",
+		ClosedAt:    "01/03/2022 10:10",
+	}
+
+	errs := normalizeTimestamps(&stats)
+
+	if stats.CreatedAt != "2022-03-01T10:00:00Z" {
+		t.Errorf("created at = %q, want it converted to UTC", stats.CreatedAt)
+	}
+	if stats.ConfirmedAt != "2022-03-01T10:00:30.5Z" {
+		t.Errorf("confirmed at = %q, want fractional seconds kept", stats.ConfirmedAt)
+	}
+	if stats.ClosedAt != "" {
+		t.Errorf("closed at = %q, want unparseable value cleared", stats.ClosedAt)
+	}
+	if len(errs) != 1 {
+		t.Errorf("got %d errors, want 1: %v", len(errs), errs)
+	}
+}
+
+func TestHasNonUTCOffset(t *testing.T) {
+	tests := []struct {
+		ts   string
+		want bool
+	}{
+		{ts: "2022-03-01T10:00:00Z", want: false},
+		{ts: "2022-03-01T10:00:00.123Z", want: false},
+		{ts: "2022-03-01T12:00:00+02:00", want: true},
+		{ts: "2022-03-01T10:00:00-00:00", want: true},
+		{ts: "yesterday", want: false},
+		{ts: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := hasNonUTCOffset(tt.ts); got != tt.want {
+			t.Errorf("hasNonUTCOffset(%q) = %v, want %v", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestFilterByMarket(t *testing.T) {
+	stats := map[string]*SessionStats{
+		"s1": {ID: "s1", Market: "pl"},
+		"s2": {ID: "s2", Market: "us"},
+		"s3": {ID: "s3"},
+	}
+
+	filterByMarket(stats, "pl")
+
+	if len(stats) != 1 || stats["s1"] == nil {
+		t.Errorf("got %v, want only s1", stats)
+	}
+}
+
+func TestFillStatBasedOnItemDeduplicatesReplayedAssignments(t *testing.T) {
+	var s SessionStats
+	for _, item := range []DynamoItem{
+		{Metadata: TutorAssignedToSessionEvent + "#a", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T10:00:05Z"},
+		{Metadata: TutorAssignedToSessionEvent + "#b", EventTime: "2022-03-01T10:00:05Z", CreatedAt: "2022-03-01T12:00:00Z"},
+		{Metadata: TutorAssignedToSessionEvent + "#c", EventTime: "2022-03-01T10:00:30Z", CreatedAt: "2022-03-01T10:00:30Z"},
+		// Without eventTime a replay can't be recognized, so both count.
+		{Metadata: TutorAssignedToSessionEvent + "#d", CreatedAt: "2022-03-01T10:01:00Z"},
+		{Metadata: TutorAssignedToSessionEvent + "#e", CreatedAt: "2022-03-01T12:01:00Z"},
+	} {
+		if err := FillStatBasedOnItem(&s, item, TimeSourceIngestion); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.NoOfAssignAttempts != 4 {
+		t.Errorf("assign attempts = %d, want 4 distinct attempts", s.NoOfAssignAttempts)
+	}
+}
+
+func TestFillStatBasedOnItemCreationConflict(t *testing.T) {
+	for _, order := range [][]DynamoItem{
+		{
+			{Metadata: SessionCreatedByTutorEvent + "#2", CreatedAt: "2022-03-01T10:00:05Z"},
+			{Metadata: SessionCreatedByUserEvent + "#1", CreatedAt: "2022-03-01T10:00:00Z"},
+		},
+		{
+			{Metadata: SessionCreatedByUserEvent + "#1", CreatedAt: "2022-03-01T10:00:00Z"},
+			{Metadata: SessionCreatedByTutorEvent + "#2", CreatedAt: "2022-03-01T10:00:05Z"},
+		},
+	} {
+		var stats SessionStats
+		for _, item := range order {
+			if err := FillStatBasedOnItem(&stats, item, TimeSourceIngestion); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !stats.CreationConflict {
+			t.Error("expected the second creation event to be flagged")
+		}
+		if stats.CreatedAt != "2022-03-01T10:00:00Z" || stats.CreatedByRole != "USER" {
+			t.Errorf("got creation %s by %s, want the earliest one by USER", stats.CreatedAt, stats.CreatedByRole)
+		}
+	}
+}
+
+func TestTimeAttributesAreProjected(t *testing.T) {
+	for source, attribute := range timeAttributes {
+		found := false
+		for _, a := range projectedAttributes {
+			found = found || a == attribute
+		}
+		if !found {
+			t.Errorf("time source %s attribute %q is not in the projection %v", source, attribute, projectedAttributes)
+		}
+	}
+}
+
+func TestNewScanInputProjectsEveryDynamoItemField(t *testing.T) {
+	input := newScanInput(Options{Table: "sessions", TimeSource: TimeSourceIngestion})
+
+	want := "#id,#metadata,#createdAt,#eventTime,#market,#rating"
+	if got := *input.ProjectionExpression; got != want {
+		t.Errorf("projection = %q, want %q", got, want)
+	}
+
+	for _, a := range dynamoAttributes(reflect.TypeOf(DynamoItem{})) {
+		if got := input.ExpressionAttributeNames["#"+a]; got != a {
+			t.Errorf("placeholder #%s = %q, want %q", a, got, a)
+		}
+	}
+}
+
+func TestMarshalToCSV(t *testing.T) {
+	var b strings.Builder
+	stats := map[string]*SessionStats{
+		"s1": {ID: "s1", Market: "pl", NoOfAssignAttempts: 2, Rating: intPtr(5)},
+	}
+
+	if err := MarshalToCSV(&b, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want header and one row:\n%s", len(lines), b.String())
+	}
+	if !strings.HasPrefix(lines[0], "id,market,no_of_assign_attempts,") {
+		t.Errorf("unexpected header %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "s1,pl,2,") {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+}
+
+func TestMarshalToCSVOptionalColumns(t *testing.T) {
+	var b strings.Builder
+	stats := map[string]*SessionStats{
+		"missing": {ID: "missing"},
+		"zero":    {ID: "zero", Rating: intPtr(0), SessionDurationSeconds: intPtr(0)},
+		"set":     {ID: "set", Rating: intPtr(5), SessionDurationSeconds: intPtr(60)},
+	}
+
+	if err := MarshalToCSV(&b, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(b.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[name] = i
+	}
+	rows := make(map[string][]string)
+	for _, r := range records[1:] {
+		rows[r[columns["id"]]] = r
+	}
+
+	want := map[string][2]string{
+		"missing": {"", ""},
+		"zero":    {"0", "0"},
+		"set":     {"5", "60"},
+	}
+	for id, w := range want {
+		row := rows[id]
+		if got := row[columns["rating"]]; got != w[0] {
+			t.Errorf("%s: rating = %q, want %q", id, got, w[0])
+		}
+		if got := row[columns["session_duration_seconds"]]; got != w[1] {
+			t.Errorf("%s: session duration = %q, want %q", id, got, w[1])
+		}
+	}
+}
+
+func TestSortedOrder(t *testing.T) {
+	stats := map[string]*SessionStats{
+		"c": {ID: "c", CreatedAt: "2022-03-01T10:00:00Z"},
+		"b": {ID: "b", CreatedAt: "2022-03-01T10:00:00Z"},
+		"d": {ID: "d", CreatedAt: "2022-03-01T09:59:59.5Z"},
+		"z": {ID: "z"},
+		"a": {ID: "a"},
+	}
+
+	var got []string
+	for _, s := range Sorted(stats) {
+		got = append(got, s.ID)
+	}
+
+	if want := "a z d b c"; strings.Join(got, " ") != want {
+		t.Errorf("got order %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"scan_playground/sessionstats"
+)
+
+// SplitMonthly is the only --split mode: one output per calendar month (UTC).
+const SplitMonthly = "monthly"
+
+// window is a slice [From, To) of the scan window that gets its own output.
+type window struct {
+	// Name labels the window's output file, e.g. "2022-03".
+	Name string
+	From time.Time
+	To   time.Time
+}
+
+// monthlyWindows cuts [from, to) at every UTC month boundary. The first and
+// last window are clipped to from and to, so they may cover part of a month.
+func monthlyWindows(from, to time.Time) []window {
+	from, to = from.UTC(), to.UTC()
+
+	var windows []window
+	for start := from; start.Before(to); {
+		end := time.Date(start.Year(), start.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		if end.After(to) {
+			end = to
+		}
+
+		windows = append(windows, window{Name: start.Format("2006-01"), From: start, To: end})
+		start = end
+	}
+
+	return windows
+}
+
+// splitByWindow buckets sessions by the window their CreatedAt falls into.
+// Sessions without a creation time were created before the scan window (see
+// PartialWindow) and go into the first window, like sessions created before
+// it. The result has one map per window, empty ones included.
+func splitByWindow(stats map[string]*sessionstats.SessionStats, windows []window) []map[string]*sessionstats.SessionStats {
+	buckets := make([]map[string]*sessionstats.SessionStats, len(windows))
+	for i := range buckets {
+		buckets[i] = make(map[string]*sessionstats.SessionStats)
+	}
+	if len(windows) == 0 {
+		return buckets
+	}
+
+	for id, s := range stats {
+		i := 0
+		if createdAt, err := time.Parse(time.RFC3339, s.CreatedAt); err == nil {
+			for i < len(windows)-1 && !createdAt.Before(windows[i].To) {
+				i++
+			}
+		}
+		buckets[i][id] = s
+	}
+
+	return buckets
+}
+
+// windowDest derives the destination of a window's output from dest by
+// inserting "-<window name>" before the extension, so
+// "s3://bucket/sessions.csv" becomes "s3://bucket/sessions-2022-03.csv".
+func windowDest(dest string, w window) string {
+	ext := path.Ext(dest)
+	return strings.TrimSuffix(dest, ext) + "-" + w.Name + ext
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"scan_playground/sessionstats"
+)
+
+func TestMonthlyWindows(t *testing.T) {
+	from := time.Date(2022, 1, 15, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	windows := monthlyWindows(from, to)
+
+	want := []window{
+		{Name: "2022-01", From: from, To: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "2022-02", From: time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Name: "2022-03", From: time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), To: to},
+	}
+	if len(windows) != len(want) {
+		t.Fatalf("got %d windows, want %d: %+v", len(windows), len(want), windows)
+	}
+	for i := range want {
+		if windows[i].Name != want[i].Name || !windows[i].From.Equal(want[i].From) || !windows[i].To.Equal(want[i].To) {
+			t.Errorf("window %d = %+v, want %+v", i, windows[i], want[i])
+		}
+	}
+}
+
+func TestSplitByWindow(t *testing.T) {
+	windows := monthlyWindows(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC))
+	stats := map[string]*sessionstats.SessionStats{
+		"jan":     {ID: "jan", CreatedAt: "2022-01-31T23:59:59Z"},
+		"feb":     {ID: "feb", CreatedAt: "2022-02-01T00:00:00Z"},
+		"partial": {ID: "partial", ClosedAt: "2022-02-10T00:00:00Z", PartialWindow: true},
+	}
+
+	buckets := splitByWindow(stats, windows)
+
+	if len(buckets) != 2 {
+		t.Fatalf("got %d buckets, want 2", len(buckets))
+	}
+	if buckets[0]["jan"] == nil || buckets[0]["partial"] == nil || len(buckets[0]) != 2 {
+		t.Errorf("January bucket = %v, want jan and partial", buckets[0])
+	}
+	if buckets[1]["feb"] == nil || len(buckets[1]) != 1 {
+		t.Errorf("February bucket = %v, want feb", buckets[1])
+	}
+}
+
+func TestWindowDest(t *testing.T) {
+	w := window{Name: "2022-03"}
+	tests := map[string]string{
+		"sessions.csv":                 "sessions-2022-03.csv",
+		"out/sessions":                 "out/sessions-2022-03",
+		"s3://bucket/exports/s.jsonl":  "s3://bucket/exports/s-2022-03.jsonl",
+		"s3://bucket.with.dots/export": "s3://bucket.with.dots/export-2022-03",
+	}
+
+	for dest, want := range tests {
+		if got := windowDest(dest, w); got != want {
+			t.Errorf("windowDest(%q) = %q, want %q", dest, got, want)
+		}
+	}
+}
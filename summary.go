@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"scan_playground/sessionstats"
+)
+
+// Reasons set by the default event mappings (defaultEventMappings in
+// sessionstats), in the order the summary reports them. A --mapping-file can
+// set other reasons; those seen are reported after these, sorted.
+var (
+	rejectedReasons = []string{"user", "matching_timeout", "no_tutors"}
+	closedReasons   = []string{"user", "tutor", "tutor_disconnected"}
+)
+
+type MarketSummary struct {
+	Market         string
+	Sessions       int
+	Created        int
+	Confirmed      int
+	Rejected       map[string]int
+	Closed         map[string]int
+	AssignAttempts int
+}
+
+func (m *MarketSummary) AvgAssignAttempts() float64 {
+	if m.Sessions == 0 {
+		return 0
+	}
+
+	return float64(m.AssignAttempts) / float64(m.Sessions)
+}
+
+// summarizeByMarket aggregates the sessions per market, ordered by market.
+// Sessions whose SESSION item wasn't seen are reported under "unknown".
+func summarizeByMarket(statsMap map[string]*sessionstats.SessionStats) []*MarketSummary {
+	markets := make(map[string]*MarketSummary)
+
+	for _, s := range statsMap {
+		market := orUnknown(s.Market)
+		m, ok := markets[market]
+		if !ok {
+			m = &MarketSummary{
+				Market:   market,
+				Rejected: make(map[string]int),
+				Closed:   make(map[string]int),
+			}
+			markets[market] = m
+		}
+
+		m.Sessions++
+		m.AssignAttempts += s.NoOfAssignAttempts
+		if s.CreatedAt != "" {
+			m.Created++
+		}
+		if s.ConfirmedAt != "" {
+			m.Confirmed++
+		}
+		if s.RejectedAt != "" {
+			m.Rejected[s.RejectedReason]++
+		}
+		if s.ClosedAt != "" {
+			m.Closed[s.ClosedReason]++
+		}
+	}
+
+	summaries := make([]*MarketSummary, 0, len(markets))
+	for _, m := range markets {
+		summaries = append(summaries, m)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Market < summaries[j].Market })
+
+	return summaries
+}
+
+// reasonColumns returns known followed by the other reasons counted by
+// reasons in any of the summaries, sorted.
+func reasonColumns(summaries []*MarketSummary, known []string, reasons func(*MarketSummary) map[string]int) []string {
+	columns := append([]string(nil), known...)
+	seen := make(map[string]bool)
+	for _, r := range known {
+		seen[r] = true
+	}
+
+	var extra []string
+	for _, m := range summaries {
+		for r := range reasons(m) {
+			if !seen[r] {
+				seen[r] = true
+				extra = append(extra, r)
+			}
+		}
+	}
+	sort.Strings(extra)
+
+	return append(columns, extra...)
+}
+
+// writeSummary renders the summaries as an aligned, tab separated table.
+func writeSummary(w io.Writer, summaries []*MarketSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	rejected := reasonColumns(summaries, rejectedReasons, func(m *MarketSummary) map[string]int { return m.Rejected })
+	closed := reasonColumns(summaries, closedReasons, func(m *MarketSummary) map[string]int { return m.Closed })
+
+	header := []string{"market", "sessions", "created", "confirmed"}
+	for _, r := range rejected {
+		header = append(header, "rejected_"+r)
+	}
+	for _, r := range closed {
+		header = append(header, "closed_"+r)
+	}
+	header = append(header, "avg_assign_attempts")
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+
+	for _, m := range summaries {
+		row := []string{m.Market, fmt.Sprint(m.Sessions), fmt.Sprint(m.Created), fmt.Sprint(m.Confirmed)}
+		for _, r := range rejected {
+			row = append(row, fmt.Sprint(m.Rejected[r]))
+		}
+		for _, r := range closed {
+			row = append(row, fmt.Sprint(m.Closed[r]))
+		}
+		row = append(row, fmt.Sprintf("%.2f", m.AvgAssignAttempts()))
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
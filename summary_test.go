@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func TestSummarizeByMarket(t *testing.T) {
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {Market: "pl", CreatedAt: "t", ConfirmedAt: "t", ClosedAt: "t", ClosedReason: "tutor", NoOfAssignAttempts: 1},
+		"s2": {Market: "pl", CreatedAt: "t", RejectedAt: "t", RejectedReason: "no_tutors", NoOfAssignAttempts: 2},
+		"s3": {Market: "us", CreatedAt: "t", RejectedAt: "t", RejectedReason: "user"},
+		"s4": {ConfirmedAt: "t"},
+	}
+
+	summaries := summarizeByMarket(stats)
+	if len(summaries) != 3 {
+		t.Fatalf("got %d markets, want 3", len(summaries))
+	}
+
+	pl := summaries[0]
+	if pl.Market != "pl" || pl.Sessions != 2 || pl.Created != 2 || pl.Confirmed != 1 {
+		t.Errorf("unexpected pl summary: %+v", pl)
+	}
+	if pl.Rejected["no_tutors"] != 1 || pl.Closed["tutor"] != 1 {
+		t.Errorf("unexpected pl reasons: rejected %v, closed %v", pl.Rejected, pl.Closed)
+	}
+	if got := pl.AvgAssignAttempts(); got != 1.5 {
+		t.Errorf("pl avg assign attempts = %v, want 1.5", got)
+	}
+
+	if summaries[1].Market != unknownGroup || summaries[1].Created != 0 {
+		t.Errorf("unexpected summary for sessions without market: %+v", summaries[1])
+	}
+}
+
+func TestWriteSummary(t *testing.T) {
+	var b strings.Builder
+	summaries := []*MarketSummary{{
+		Market:         "pl",
+		Sessions:       2,
+		Created:        2,
+		Rejected:       map[string]int{"no_tutors": 1},
+		Closed:         map[string]int{},
+		AssignAttempts: 3,
+	}}
+
+	if err := writeSummary(&b, summaries); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want header and one row:\n%s", len(lines), b.String())
+	}
+	if got := strings.Fields(lines[1]); strings.Join(got, " ") != "pl 2 2 0 0 0 1 0 0 0 1.50" {
+		t.Errorf("unexpected row %q", lines[1])
+	}
+}
+
+func TestWriteSummaryCustomReasons(t *testing.T) {
+	var b strings.Builder
+	summaries := []*MarketSummary{
+		{Market: "pl", Sessions: 1, Rejected: map[string]int{"fraud": 1}, Closed: map[string]int{}},
+		{Market: "us", Sessions: 2, Rejected: map[string]int{"blocked": 1, "user": 1}, Closed: map[string]int{"timeout": 1}},
+	}
+
+	if err := writeSummary(&b, summaries); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	wantHeader := "market sessions created confirmed rejected_user rejected_matching_timeout rejected_no_tutors rejected_blocked rejected_fraud " +
+		"closed_user closed_tutor closed_tutor_disconnected closed_timeout avg_assign_attempts"
+	if got := strings.Join(strings.Fields(lines[0]), " "); got != wantHeader {
+		t.Errorf("header = %q, want %q", got, wantHeader)
+	}
+	if got := strings.Join(strings.Fields(lines[2]), " "); got != "us 2 0 0 1 0 0 1 0 0 0 0 1 0.00" {
+		t.Errorf("unexpected us row %q", lines[2])
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"text/template"
+
+	"scan_playground/sessionstats"
+)
+
+// rowTemplates renders sessions with user supplied text/template files: the
+// row template is executed once per session, the optional header and
+// footer templates once with the whole slice of rows.
+type rowTemplates struct {
+	header *template.Template
+	row    *template.Template
+	footer *template.Template
+}
+
+// templateFuncs are available to every output template.
+var templateFuncs = template.FuncMap{
+	"value": value,
+}
+
+// value dereferences pointer fields such as Rating for templates, rendering a
+// nil one as an empty string instead of "<nil>": {{value .Rating}}.
+func value(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr {
+		return v
+	}
+	if rv.IsNil() {
+		return ""
+	}
+
+	return rv.Elem().Interface()
+}
+
+func parseTemplateFile(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.New(path).Funcs(templateFuncs).Parse(string(content))
+}
+
+func loadRowTemplates(rowPath, headerPath, footerPath string) (*rowTemplates, error) {
+	var (
+		t   rowTemplates
+		err error
+	)
+
+	if t.row, err = parseTemplateFile(rowPath); err != nil {
+		return nil, err
+	}
+	if t.header, err = parseTemplateFile(headerPath); err != nil {
+		return nil, err
+	}
+	if t.footer, err = parseTemplateFile(footerPath); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+func (t *rowTemplates) execute(w io.Writer, stats []*sessionstats.SessionStats) error {
+	if t.header != nil {
+		if err := t.header.Execute(w, stats); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range stats {
+		if err := t.row.Execute(w, s); err != nil {
+			return err
+		}
+	}
+
+	if t.footer != nil {
+		return t.footer.Execute(w, stats)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"scan_playground/sessionstats"
+)
+
+func writeTemplate(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestRowTemplates(t *testing.T) {
+	dir := t.TempDir()
+	templates, err := loadRowTemplates(
+		writeTemplate(t, dir, "row.tmpl", "{{.ID}} {{.Market}} {{.NoOfAssignAttempts}}\n"),
+		writeTemplate(t, dir, "header.tmpl", "sessions: {{len .}}\n"),
+		writeTemplate(t, dir, "footer.tmpl", "end\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	stats := map[string]*sessionstats.SessionStats{
+		"s2": {ID: "s2", Market: "us"},
+		"s1": {ID: "s1", Market: "pl", NoOfAssignAttempts: 2},
+	}
+	if err := writeResults(&b, stats, outputOptions{Templates: templates}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "sessions: 2\ns1 pl 2\ns2 us 0\nend\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestLoadRowTemplatesRejectsInvalidTemplate(t *testing.T) {
+	dir := t.TempDir()
+	row := writeTemplate(t, dir, "row.tmpl", "{{.ID}}\n")
+	broken := writeTemplate(t, dir, "broken.tmpl", "{{if .ID}}unterminated\n")
+
+	for _, paths := range [][3]string{
+		{broken, "", ""},
+		{row, broken, ""},
+		{row, "", broken},
+	} {
+		if _, err := loadRowTemplates(paths[0], paths[1], paths[2]); err == nil {
+			t.Errorf("loadRowTemplates(%q, %q, %q) accepted a template that doesn't parse", paths[0], paths[1], paths[2])
+		}
+	}
+
+	if _, err := loadRowTemplates(filepath.Join(dir, "missing.tmpl"), "", ""); err == nil {
+		t.Error("loadRowTemplates accepted a missing file")
+	}
+}
+
+func TestTemplateValue(t *testing.T) {
+	dir := t.TempDir()
+	templates, err := loadRowTemplates(writeTemplate(t, dir, "row.tmpl", "{{.ID}},{{value .Rating}},{{value .ID}}\n"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	stats := map[string]*sessionstats.SessionStats{
+		"s1": {ID: "s1"},
+		"s2": {ID: "s2", Rating: intPtr(0)},
+		"s3": {ID: "s3", Rating: intPtr(5)},
+	}
+	if err := writeResults(&b, stats, outputOptions{Templates: templates}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "s1,,s1\ns2,0,s2\ns3,5,s3\n"
+	if b.String() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", b.String(), want)
+	}
+}